@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"net"
 	"net/http"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/closer"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/handler"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
 	myMigrate "github.com/MrSwed/go-musthave-shortener/internal/app/migrate"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/service"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/tlscert"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -30,14 +37,37 @@ func main() {
 }
 
 func runServer(ctx context.Context) {
-	conf := config.NewConfig().Init()
-	var err error
+	conf, err := config.NewConfig().Init()
 	logrus.SetFormatter(&logrus.TextFormatter{
 		TimestampFormat: "2006-01-02 15:04:05",
 		FullTimestamp:   true,
 	})
-
-	logrus.WithFields(logrus.Fields{"config": conf}).Info("Start server")
+	if err != nil {
+		logrus.WithError(err).Fatal("Config")
+	}
+	log, err := logger.New(conf.LogLevel, conf.LogFormat)
+	if err != nil {
+		logrus.WithError(err).Fatal("Logger")
+	}
+	keys, err := storageKeys(conf)
+	if err != nil {
+		log.WithError(err).Fatal("Storage keys")
+	}
+	if conf.StorageReencrypt {
+		if err = reencrypt(conf, keys, log); err != nil {
+			log.WithError(err).Fatal("Storage re-encrypt")
+		}
+		log.WithField("key", keys.ActiveID()).Info("Storage re-encrypted")
+		return
+	}
+	if conf.SecretKey == "" {
+		// the cookies signed and the ip hashed before the restart are not recognized after it
+		if conf.SecretKey, err = config.RandomSecret(32); err != nil {
+			log.WithError(err).Fatal("Secret key")
+		}
+		log.Warn("No secret key is set, the random one is used until the restart")
+	}
+	log.WithFields(logrus.Fields{"config": conf}).Info("Start server")
 
 	var (
 		db      *sqlx.DB
@@ -45,36 +75,65 @@ func runServer(ctx context.Context) {
 		c       = &closer.Closer{}
 	)
 	if len(conf.DatabaseDSN) > 0 {
-		if db, err = sqlx.Open("pgx", conf.DatabaseDSN); err != nil {
-			logrus.WithError(err).Fatal("cannot connect db")
+		if db, err = sqlx.Open("pgx", string(conf.DatabaseDSN)); err != nil {
+			log.WithError(err).Fatal("cannot connect db")
 		}
-		logrus.Info("DB connected")
+		log.Info("DB connected")
 		versions, errM := myMigrate.Migrate(db.DB)
 		switch {
 		case errors.Is(errM, migrate.ErrNoChange):
-			logrus.Info("DB migrate: ", errM, versions)
+			log.Info("DB migrate: ", errM, versions)
 		case errM == nil:
-			logrus.Info("DB migrate: new applied ", versions)
+			log.Info("DB migrate: new applied ", versions)
 		default:
-			logrus.WithError(err).Fatal("DB migrate: ", versions)
+			log.WithError(err).Fatal("DB migrate: ", versions)
 		}
 		isNewDB = versions[0] == 0
+		metrics.RegisterDBStats(metrics.Default, db)
 	}
 
-	r := repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db})
-	s := service.NewService(r, conf)
-	h := handler.NewHandler(s)
+	var checkers []service.URLChecker
+	if conf.BlocklistFile != "" {
+		blocklist, err := service.NewBlocklistChecker(conf.BlocklistFile, log)
+		if err != nil {
+			log.WithError(err).Fatal("Blocklist load")
+		}
+		checkers = append(checkers, blocklist)
+		c.AddPhase(closer.PhaseWorkers, "Blocklist", 0, blocklist.Close)
+	}
+
+	gen, err := shortcode.New(conf.ShortGenerator, conf.ShortAlphabet, conf.ShortLength)
+	if err != nil {
+		log.WithError(err).Fatal("Short code generator")
+	}
+	r := repository.NewRepository(repository.Config{
+		StorageFile:      conf.FileStoragePath,
+		WALSync:          conf.WALSync,
+		Recover:          conf.StorageRecover,
+		Keys:             keys,
+		Generator:        gen,
+		KeyPoolSize:      conf.KeyPoolSize,
+		OperationTimeout: conf.OperationTimeoutDuration(),
+		DB:               db,
+		Log:              log,
+	})
+	if r.KeyPool != nil {
+		metrics.RegisterKeyPool(metrics.Default, r.KeyPool)
+	}
+	s := service.NewService(r, conf, log, checkers...)
+	h := handler.NewHandler(s, conf, log)
 
 	if conf.FileStoragePath != "" && isNewDB {
 		data, err := r.Restore()
 		if err != nil {
-			logrus.WithError(err).Error("Storage restore")
+			// the file is saved over on shutdown, so the server does not start with the data lost
+			log.WithError(err).Fatal("Storage restore, start with -storage-recover to skip the damaged records")
 		}
 		if data != nil {
 			if err = s.RestoreAll(data); err != nil {
-				logrus.Error(err)
+				log.Error(err)
 			} else {
-				logrus.Info("Storage restored")
+				log.Info("Storage restored")
 			}
 		}
 	}
@@ -83,57 +142,125 @@ func runServer(ctx context.Context) {
 		Addr:    conf.ServerAddress,
 		Handler: h.Handler(),
 	}
-	lockDBCLose := make(chan struct{})
-	c.Add("WEB", server.Shutdown)
+	if conf.EnableHTTPS {
+		if server.TLSConfig, err = newTLSConfig(conf, log); err != nil {
+			log.WithError(err).Fatal("TLS config")
+		}
+	}
+	// the web server gets half of the shutdown time, the rest is for the workers to drain
+	c.AddPhase(closer.PhaseHTTP, "WEB", conf.ShutdownTimeoutDuration()/2, server.Shutdown)
+	c.AddPhase(closer.PhaseWorkers, "Deleter", 0, s.Deleter.Close)
+	c.AddPhase(closer.PhaseWorkers, "Clicker", 0, s.Clicker.Close)
+	c.AddPhase(closer.PhaseWorkers, "Reaper", 0, s.Reaper.Close)
+	c.AddPhase(closer.PhaseWorkers, "Compactor", 0, s.Compactor.Close)
 	if conf.FileStoragePath != "" {
-		c.Add("FileStorage", func(ctx context.Context) error {
-			defer func() {
-				if db != nil {
-					close(lockDBCLose)
-				}
-			}()
-			if store, err := s.GetAll(ctx); err != nil {
-				logrus.WithError(err).Error("Can get data for save to disk")
-				return err
-			} else if err := r.FileStorage.Save(store); err != nil {
-				logrus.WithError(err).Error("Can not save data")
-				return err
-			} else {
-				logrus.Info("Storage saved")
+		c.AddPhase(closer.PhaseStorage, "FileStorage", 0, func(ctx context.Context) error {
+			if err := r.FileStorage.Compact(ctx, s.GetAll); err != nil {
+				log.WithError(err).Error("Can not save data")
+				return errors.Join(err, r.FileStorage.Close())
 			}
-			return nil
+			log.Info("Storage saved")
+			return r.FileStorage.Close()
 		})
-	} else {
-		close(lockDBCLose)
+	}
+	if r.KeyPool != nil {
+		// the unused codes go back to the table, before the db is closed
+		c.AddPhase(closer.PhaseStorage, "KeyPool", 0, r.KeyPool.Close)
 	}
 	if db != nil {
-		c.Add("DB", func(ctx context.Context) (err error) {
-			<-lockDBCLose
+		c.AddPhase(closer.PhaseDB, "DB", 0, func(ctx context.Context) (err error) {
 			if err = db.Close(); err != nil {
-				logrus.WithError(err).Error("DB close")
+				log.WithError(err).Error("DB close")
 			} else {
-				logrus.Info("Db Closed")
+				log.Info("Db Closed")
 			}
 			return
 		})
 	}
 
 	go func() {
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logrus.WithError(err).Error("Start server")
+		var err error
+		if conf.EnableHTTPS {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("Start server")
 		}
 	}()
-	logrus.Info("Server started")
+	log.Info("Server started")
 	<-ctx.Done()
 
-	logrus.Info("Shutting down server gracefully")
+	// the server is not ready for the drain period before it stops accepting, so the balancers see it
+	s.ShuttingDown()
+	log.WithField("drain", conf.ShutdownDrainDuration()).Info("Shutting down server gracefully, not ready")
+	time.Sleep(conf.ShutdownDrainDuration())
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), constant.ServerShutdownTimeout*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeoutDuration())
 	defer cancel()
 
 	if err = c.Close(shutdownCtx); err != nil {
-		logrus.Error(err, ". timeout: ", constant.ServerShutdownTimeout)
+		log.Error(err, ". timeout: ", conf.ShutdownTimeout)
+	}
+	for _, res := range c.Report() {
+		l := log.WithFields(logrus.Fields{"phase": res.Phase, "closer": res.Name, "status": res.Status, "duration": res.Duration})
+		if res.Status != closer.StatusOK {
+			l.WithError(res.Err).Warn("Closer")
+		} else {
+			l.Debug("Closer")
+		}
+	}
+
+	log.Info("Server stopped")
+}
+
+// storageKeys reads the storage encryption keys of env or the key file, nil is no encryption
+func storageKeys(conf *config.Config) (*keyring.Keyring, error) {
+	if conf.StorageKeyFile != "" {
+		return keyring.ParseFile(conf.StorageKeyFile)
+	}
+	return keyring.Parse(string(conf.StorageKeys))
+}
+
+// reencrypt rewrites the storage file and its log with the active key,
+// the records of the other keys of the keyring are read
+func reencrypt(conf *config.Config, keys *keyring.Keyring, log logrus.FieldLogger) error {
+	r := repository.NewRepository(repository.Config{
+		StorageFile: conf.FileStoragePath,
+		WALSync:     conf.WALSync,
+		Recover:     conf.StorageRecover,
+		Keys:        keys,
+		Log:         log,
+	})
+	data, err := r.Restore()
+	if err != nil {
+		return errors.Join(err, r.Close())
 	}
+	err = r.Compact(context.Background(), func(context.Context) (repository.Store, error) {
+		return data, nil
+	})
+	return errors.Join(err, r.Close())
+}
 
-	logrus.Info("Server stopped")
+// newTLSConfig serves the certificate files, reloaded on change,
+// or the self-signed one when no files provided
+func newTLSConfig(conf *config.Config, log logrus.FieldLogger) (*tls.Config, error) {
+	if conf.TLSCertFile != "" || conf.TLSKeyFile != "" {
+		reloader, err := tlscert.NewReloader(conf.TLSCertFile, conf.TLSKeyFile, log)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+	}
+	host, _, _ := strings.Cut(conf.BaseURL, "/")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	cert, err := tlscert.SelfSigned(host, "localhost", "127.0.0.1")
+	if err != nil {
+		return nil, err
+	}
+	log.Warn("Self-signed certificate is used")
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
@@ -4,53 +4,176 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Phase orders the closers: all the closers of the phase are run concurrently,
+// the next phase starts when every closer of the previous one is finished
+type Phase int
+
+const (
+	PhaseHTTP Phase = iota
+	PhaseWorkers
+	PhaseStorage
+	PhaseDB
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseHTTP:
+		return "http"
+	case PhaseWorkers:
+		return "workers"
+	case PhaseStorage:
+		return "storage"
+	case PhaseDB:
+		return "db"
+	}
+	return fmt.Sprintf("phase %d", int(p))
+}
+
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusTimeout = "timeout"
+	StatusSkipped = "skipped"
+)
+
+// Result is the report of the one closer
+type Result struct {
+	Name     string
+	Phase    Phase
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+type Report []Result
+
+func (r Report) String() string {
+	items := make([]string, len(r))
+	for i, res := range r {
+		items[i] = fmt.Sprintf("%s/%s: %s (%s)", res.Phase, res.Name, res.Status, res.Duration.Round(time.Millisecond))
+		if res.Err != nil {
+			items[i] += " " + res.Err.Error()
+		}
+	}
+	return strings.Join(items, "; ")
+}
+
+type closer struct {
+	name    string
+	phase   Phase
+	timeout time.Duration
+	f       Func
+}
+
 type Closer struct {
-	mu    sync.Mutex
-	funcs []Func
-	names []string
+	mu      sync.Mutex
+	closers []closer
+	report  Report
 }
 
+// Add registers the closer to the first phase without own timeout
 func (c *Closer) Add(n string, f Func) {
+	c.AddPhase(PhaseHTTP, n, 0, f)
+}
+
+// AddPhase registers the closer to the phase, the closer is cancelled after
+// the timeout if it is positive, or with the Close context only
+func (c *Closer) AddPhase(p Phase, n string, timeout time.Duration, f Func) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.names = append(c.names, n)
-	c.funcs = append(c.funcs, f)
+	c.closers = append(c.closers, closer{name: n, phase: p, timeout: timeout, f: f})
 }
 
+// Close runs the closers phase by phase. When ctx is done, the closers still running
+// are reported as timed out and the next phases are skipped
 func (c *Closer) Close(ctx context.Context) (err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	closers := make([]closer, len(c.closers))
+	copy(closers, c.closers)
+	sort.SliceStable(closers, func(i, j int) bool { return closers[i].phase < closers[j].phase })
+
 	var (
-		wg       sync.WaitGroup
-		complete = make(chan struct{}, 1)
+		errM   sync.Mutex
+		addErr = func(e error) {
+			errM.Lock()
+			defer errM.Unlock()
+			err = errors.Join(err, e)
+		}
 	)
-
-	wg.Add(len(c.funcs))
-	for i, f := range c.funcs {
-		i, f := i, f
-		go func() {
-			if errF := f(ctx); errF != nil {
-				err = errors.Join(err, fmt.Errorf("close %s error: %w", c.names[i], errF))
+	c.report = make(Report, len(closers))
+	for start := 0; start < len(closers); {
+		end := start
+		for end < len(closers) && closers[end].phase == closers[start].phase {
+			end++
+		}
+		if ctx.Err() != nil {
+			for i := start; i < len(closers); i++ {
+				c.report[i] = Result{Name: closers[i].name, Phase: closers[i].phase, Status: StatusSkipped}
 			}
-			wg.Done()
-		}()
+			addErr(fmt.Errorf("shutdown cancelled: %w", ctx.Err()))
+			return
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(end - start)
+		for i := start; i < end; i++ {
+			go func(i int) {
+				defer wg.Done()
+				c.report[i] = run(ctx, closers[i])
+				if c.report[i].Err != nil {
+					addErr(fmt.Errorf("close %s error: %w", closers[i].name, c.report[i].Err))
+				}
+			}(i)
+		}
+		wg.Wait()
+		start = end
 	}
+
+	return
+}
+
+// Report returns the results of the last Close in the order the closers were run
+func (c *Closer) Report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(Report(nil), c.report...)
+}
+
+// run waits for the closer to finish or its context is done,
+// the closer is not stopped then and may still run in background
+func run(ctx context.Context, cl closer) (res Result) {
+	res = Result{Name: cl.name, Phase: cl.phase}
+	if cl.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cl.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
 	go func() {
-		wg.Wait()
-		complete <- struct{}{}
+		done <- cl.f(ctx)
 	}()
 
 	select {
-	case <-complete:
-		break
+	case res.Err = <-done:
+		res.Status = StatusOK
+		if res.Err != nil {
+			res.Status = StatusFailed
+		}
 	case <-ctx.Done():
-		return fmt.Errorf("shutdown cancelled: %s", ctx.Err())
+		res.Status = StatusTimeout
+		res.Err = ctx.Err()
 	}
-
+	res.Duration = time.Since(start)
 	return
 }
 
@@ -0,0 +1,121 @@
+package closer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloser_PhaseOrder(t *testing.T) {
+	var (
+		c     Closer
+		m     sync.Mutex
+		order []string
+	)
+	closeFunc := func(name string, d time.Duration) Func {
+		return func(context.Context) error {
+			time.Sleep(d)
+			m.Lock()
+			defer m.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+	// registered in reverse, the slow closer of the phase is still waited for by the next one
+	c.AddPhase(PhaseDB, "db", 0, closeFunc("db", 0))
+	c.AddPhase(PhaseStorage, "storage", 0, closeFunc("storage", 0))
+	c.AddPhase(PhaseWorkers, "workers", 0, closeFunc("workers", 0))
+	c.AddPhase(PhaseHTTP, "web slow", 0, closeFunc("web slow", 20*time.Millisecond))
+	c.Add("web", closeFunc("web", 0))
+
+	require.NoError(t, c.Close(context.Background()))
+	require.Len(t, order, 5)
+	assert.ElementsMatch(t, []string{"web", "web slow"}, order[:2])
+	assert.Equal(t, []string{"workers", "storage", "db"}, order[2:])
+
+	var phases []Phase
+	for _, res := range c.Report() {
+		phases = append(phases, res.Phase)
+		assert.Equal(t, StatusOK, res.Status)
+	}
+	assert.Equal(t, []Phase{PhaseHTTP, PhaseHTTP, PhaseWorkers, PhaseStorage, PhaseDB}, phases)
+}
+
+func TestCloser_Timeout(t *testing.T) {
+	var c Closer
+	release := make(chan struct{})
+	defer close(release)
+	c.AddPhase(PhaseWorkers, "slow", 10*time.Millisecond, func(context.Context) error {
+		<-release
+		return nil
+	})
+	c.AddPhase(PhaseStorage, "storage", 0, func(context.Context) error { return nil })
+
+	err := c.Close(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	report := c.Report()
+	require.Len(t, report, 2)
+	assert.Equal(t, StatusTimeout, report[0].Status)
+	assert.Equal(t, StatusOK, report[1].Status, "the own timeout of the closer does not stop the next phases")
+}
+
+func TestCloser_Cancelled(t *testing.T) {
+	var (
+		c      Closer
+		called bool
+	)
+	release := make(chan struct{})
+	defer close(release)
+	c.AddPhase(PhaseHTTP, "web", 0, func(context.Context) error {
+		<-release
+		return nil
+	})
+	c.AddPhase(PhaseStorage, "storage", 0, func(context.Context) error {
+		called = true
+		return nil
+	})
+	c.AddPhase(PhaseDB, "db", 0, func(context.Context) error {
+		called = true
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := c.Close(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "shutdown cancelled")
+	assert.False(t, called)
+
+	report := c.Report()
+	require.Len(t, report, 3)
+	assert.Equal(t, StatusTimeout, report[0].Status)
+	assert.Equal(t, StatusSkipped, report[1].Status)
+	assert.Equal(t, StatusSkipped, report[2].Status)
+}
+
+func TestCloser_Report(t *testing.T) {
+	var c Closer
+	errClose := errors.New("close failed")
+	c.AddPhase(PhaseWorkers, "deleter", 0, func(context.Context) error { return nil })
+	c.AddPhase(PhaseStorage, "file", 0, func(context.Context) error { return errClose })
+
+	assert.Empty(t, c.Report(), "no report before close")
+	err := c.Close(context.Background())
+	assert.ErrorIs(t, err, errClose)
+
+	report := c.Report()
+	require.Len(t, report, 2)
+	assert.Equal(t, Result{Name: "deleter", Phase: PhaseWorkers, Status: StatusOK, Duration: report[0].Duration}, report[0])
+	assert.Equal(t, StatusFailed, report[1].Status)
+	assert.ErrorIs(t, report[1].Err, errClose)
+	assert.Regexp(t, `^workers/deleter: ok \(\S+\); storage/file: failed \(\S+\) close failed$`, report.String())
+
+	// the report is the copy
+	report[0].Status = StatusFailed
+	assert.Equal(t, StatusOK, c.Report()[0].Status)
+}
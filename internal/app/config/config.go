@@ -1,37 +1,257 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"math"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type ShortKey [constant.ShortLen]byte
+// ShortKey is a short code: generated one of the configured length
+// or a custom alias up to constant.AliasMaxLen
+type ShortKey string
 
 func (s ShortKey) String() string {
-	return string(s[:])
+	return string(s)
+}
+
+// RateLimit is requests per second with the burst, set as "rate" or "rate:burst".
+// Zero rate is no limit, the burst defaults to the rate rounded up
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (r *RateLimit) String() string {
+	if r == nil || r.Rate == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(r.Rate, 'f', -1, 64) + ":" + strconv.Itoa(r.Burst)
+}
+
+func (r *RateLimit) Set(s string) (err error) {
+	rate, burst, hasBurst := strings.Cut(s, ":")
+	var l RateLimit
+	if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil || l.Rate < 0 {
+		return fmt.Errorf("bad rate limit %q", s)
+	}
+	l.Burst = int(math.Ceil(l.Rate))
+	if hasBurst {
+		if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst < 1 {
+			return fmt.Errorf("bad rate limit burst %q", s)
+		}
+	}
+	*r = l
+	return nil
+}
+
+func (r *RateLimit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return r.Set(s)
+}
+
+func (r RateLimit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// List is the comma separated values
+type List []string
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Secret is the value not shown in the logs
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "***"
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// SecretList is the List not shown in the logs
+type SecretList List
+
+func (l SecretList) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return "***"
+}
+
+func (l *SecretList) Set(s string) error {
+	return (*List)(l).Set(s)
+}
+
+func (l SecretList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// RandomSecret is the secret of the n random bytes, hex encoded
+func RandomSecret(n int) (Secret, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Secret(hex.EncodeToString(b)), nil
 }
 
 type Config struct {
-	ServerAddress   string
-	BaseURL         string
-	FileStoragePath string
-	DatabaseDSN     string
-	Scheme          string
+	ServerAddress    string     `json:"server_address"`
+	BaseURL          string     `json:"base_url"`
+	FileStoragePath  string     `json:"file_storage_path"`
+	DatabaseDSN      Secret     `json:"database_dsn"`
+	Scheme           string     `json:"-"`
+	SecretKey        Secret     `json:"secret_key"`
+	SortQuery        bool       `json:"sort_query"`
+	BlocklistFile    string     `json:"blocklist_file"`
+	MaxChainDepth    int        `json:"max_chain_depth"`
+	RateCreate       RateLimit  `json:"rate_limit_create"`
+	RateRedirect     RateLimit  `json:"rate_limit_redirect"`
+	TrustedProxies   List       `json:"trusted_proxies"`
+	APIKeys          SecretList `json:"api_keys"`
+	EnableHTTPS      bool       `json:"enable_https"`
+	TLSCertFile      string     `json:"tls_cert_file"`
+	TLSKeyFile       string     `json:"tls_key_file"`
+	ShutdownTimeout  int        `json:"shutdown_timeout"`
+	OperationTimeout int        `json:"operation_timeout"`
+	ShutdownDrain    int        `json:"shutdown_drain"`
+	LogLevel         string     `json:"log_level"`
+	LogFormat        string     `json:"log_format"`
+	WALSync          string     `json:"wal_sync"`
+	CompactInterval  int        `json:"compact_interval"`
+	StorageRecover   bool       `json:"storage_recover"`
+	StorageKeys      Secret     `json:"-"`
+	StorageKeyFile   string     `json:"storage_key_file"`
+	StorageReencrypt bool       `json:"-"`
+	ShortGenerator   string     `json:"short_generator"`
+	ShortAlphabet    string     `json:"short_alphabet"`
+	ShortLength      int        `json:"short_length"`
+	KeyPoolSize      int        `json:"key_pool_size"`
+	BatchMaxSize     int        `json:"batch_max_size"`
+	ConfigFile       string     `json:"-"`
+
+	// errs are the values failed to parse, reported by Validate
+	errs []error
 }
 
 func NewConfig() *Config {
 	return &Config{
-		ServerAddress:   constant.ServerAddress,
-		BaseURL:         constant.BaseURL,
-		FileStoragePath: constant.FileStoragePath,
-		Scheme:          constant.Scheme,
+		ServerAddress:    constant.ServerAddress,
+		BaseURL:          constant.BaseURL,
+		FileStoragePath:  constant.FileStoragePath,
+		Scheme:           constant.Scheme,
+		MaxChainDepth:    constant.MaxChainDepth,
+		ShutdownTimeout:  constant.ServerShutdownTimeout,
+		OperationTimeout: constant.ServerOperationTimeout,
+		ShutdownDrain:    constant.ServerShutdownDrain,
+		LogLevel:         constant.LogLevel,
+		LogFormat:        constant.LogFormatText,
+		WALSync:          constant.WALSync,
+		CompactInterval:  constant.CompactInterval,
+		ShortGenerator:   constant.ShortGenerator,
+		ShortAlphabet:    constant.ShortAlphabet,
+		ShortLength:      constant.ShortLen,
+		KeyPoolSize:      constant.KeyPoolSize,
+		BatchMaxSize:     constant.BatchMaxSize,
+	}
+}
+
+// Init reads the settings with the precedence: flags > env > config file > defaults.
+// The config file is set by flag -c or env CONFIG. All invalid settings are reported together
+func (c *Config) Init() (*Config, error) {
+	fs := c.flagSet(os.Args[0])
+	_ = fs.Parse(os.Args[1:])
+	// only the flags given explicitly override the file and env
+	var set [][2]string
+	fs.Visit(func(f *flag.Flag) {
+		set = append(set, [2]string{f.Name, f.Value.String()})
+	})
+	configFile := c.ConfigFile
+	if envConfig, ok := os.LookupEnv(constant.EnvNameConfig); ok && envConfig != "" && configFile == "" {
+		configFile = envConfig
 	}
+
+	*c = *NewConfig()
+	c.ConfigFile = configFile
+	if err := c.WithFile(configFile); err != nil {
+		return c, err
+	}
+	c.WithEnv()
+	for _, f := range set {
+		if err := fs.Set(f[0], f[1]); err != nil {
+			c.errs = append(c.errs, fmt.Errorf("flag -%s: %w", f[0], err))
+		}
+	}
+	c.CleanParameters()
+	return c, c.Validate()
 }
 
-func (c *Config) Init() *Config {
-	return c.withFlags().WithEnv().CleanParameters()
+// WithFile reads the json config file, empty name is no file.
+// Unknown keys and bad values are collected for Validate, so all of them are reported at once
+func (c *Config) WithFile(name string) (err error) {
+	if name == "" {
+		return
+	}
+	var data []byte
+	if data, err = os.ReadFile(name); err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s: %w", name, err)
+	}
+	fields := make(map[string]any)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+			fields[tag] = v.Field(i).Addr().Interface()
+		}
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			c.errs = append(c.errs, fmt.Errorf("config file %s: unknown field %q", name, key))
+			continue
+		}
+		if errU := json.Unmarshal(raw[key], field); errU != nil {
+			c.errs = append(c.errs, fmt.Errorf("config file %s: %s: %w", name, key, errU))
+		}
+	}
+	return
 }
 
 func (c *Config) WithEnv() *Config {
@@ -45,18 +265,125 @@ func (c *Config) WithEnv() *Config {
 		c.FileStoragePath = envFileStoragePath
 	}
 	if dbDSN, ok := os.LookupEnv(constant.EnvNameDBDSN); ok {
-		c.DatabaseDSN = dbDSN
+		c.DatabaseDSN = Secret(dbDSN)
+	}
+	if secretKey, ok := os.LookupEnv(constant.EnvNameSecretKey); ok && secretKey != "" {
+		c.SecretKey = Secret(secretKey)
+	}
+	if blocklistFile, ok := os.LookupEnv(constant.EnvNameBlocklistFile); ok && blocklistFile != "" {
+		c.BlocklistFile = blocklistFile
+	}
+	c.envInt(constant.EnvNameMaxChainDepth, &c.MaxChainDepth)
+	c.envInt(constant.EnvNameShutdownTimeout, &c.ShutdownTimeout)
+	c.envInt(constant.EnvNameOperationTimeout, &c.OperationTimeout)
+	c.envInt(constant.EnvNameShutdownDrain, &c.ShutdownDrain)
+	c.envValue(constant.EnvNameRateCreate, &c.RateCreate)
+	c.envValue(constant.EnvNameRateRedirect, &c.RateRedirect)
+	if trustedProxies, ok := os.LookupEnv(constant.EnvNameTrustedProxies); ok {
+		_ = c.TrustedProxies.Set(trustedProxies)
+	}
+	if apiKeys, ok := os.LookupEnv(constant.EnvNameAPIKeys); ok {
+		_ = c.APIKeys.Set(apiKeys)
+	}
+	c.envBool(constant.EnvNameEnableHTTPS, &c.EnableHTTPS)
+	if certFile, ok := os.LookupEnv(constant.EnvNameTLSCertFile); ok && certFile != "" {
+		c.TLSCertFile = certFile
+	}
+	if keyFile, ok := os.LookupEnv(constant.EnvNameTLSKeyFile); ok && keyFile != "" {
+		c.TLSKeyFile = keyFile
+	}
+	c.envBool(constant.EnvNameSortQuery, &c.SortQuery)
+	if logLevel, ok := os.LookupEnv(constant.EnvNameLogLevel); ok && logLevel != "" {
+		c.LogLevel = logLevel
+	}
+	if logFormat, ok := os.LookupEnv(constant.EnvNameLogFormat); ok && logFormat != "" {
+		c.LogFormat = logFormat
+	}
+	if walSync, ok := os.LookupEnv(constant.EnvNameWALSync); ok && walSync != "" {
+		c.WALSync = walSync
+	}
+	c.envInt(constant.EnvNameCompactInterval, &c.CompactInterval)
+	c.envBool(constant.EnvNameStorageRecover, &c.StorageRecover)
+	if storageKeys, ok := os.LookupEnv(constant.EnvNameStorageKeys); ok && storageKeys != "" {
+		c.StorageKeys = Secret(storageKeys)
+	}
+	if storageKeyFile, ok := os.LookupEnv(constant.EnvNameStorageKeyFile); ok && storageKeyFile != "" {
+		c.StorageKeyFile = storageKeyFile
+	}
+	if shortGenerator, ok := os.LookupEnv(constant.EnvNameShortGenerator); ok && shortGenerator != "" {
+		c.ShortGenerator = shortGenerator
 	}
+	if shortAlphabet, ok := os.LookupEnv(constant.EnvNameShortAlphabet); ok && shortAlphabet != "" {
+		c.ShortAlphabet = shortAlphabet
+	}
+	c.envInt(constant.EnvNameShortLength, &c.ShortLength)
+	c.envInt(constant.EnvNameKeyPoolSize, &c.KeyPoolSize)
+	c.envInt(constant.EnvNameBatchMaxSize, &c.BatchMaxSize)
 	return c
 }
 
-func (c *Config) withFlags() *Config {
-	flag.StringVar(&c.ServerAddress, "a", c.ServerAddress, "Provide the address start server")
-	flag.StringVar(&c.BaseURL, "b", c.BaseURL, "Provide base address for short url")
-	flag.StringVar(&c.FileStoragePath, "f", c.FileStoragePath, "Provide storage file")
-	flag.StringVar(&c.DatabaseDSN, "d", c.DatabaseDSN, "Provide the database dsn connect string")
-	flag.Parse()
-	return c
+func (c *Config) envInt(name string, v *int) {
+	if env, ok := os.LookupEnv(name); ok && env != "" {
+		if i, err := strconv.Atoi(env); err != nil {
+			c.errs = append(c.errs, fmt.Errorf("env %s: %w", name, err))
+		} else {
+			*v = i
+		}
+	}
+}
+
+func (c *Config) envBool(name string, v *bool) {
+	if env, ok := os.LookupEnv(name); ok && env != "" {
+		if b, err := strconv.ParseBool(env); err != nil {
+			c.errs = append(c.errs, fmt.Errorf("env %s: %w", name, err))
+		} else {
+			*v = b
+		}
+	}
+}
+
+func (c *Config) envValue(name string, v flag.Value) {
+	if env, ok := os.LookupEnv(name); ok && env != "" {
+		if err := v.Set(env); err != nil {
+			c.errs = append(c.errs, fmt.Errorf("env %s: %w", name, err))
+		}
+	}
+}
+
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&c.ConfigFile, "c", c.ConfigFile, "Provide the json config file")
+	fs.StringVar(&c.ServerAddress, "a", c.ServerAddress, "Provide the address start server")
+	fs.StringVar(&c.BaseURL, "b", c.BaseURL, "Provide base address for short url")
+	fs.StringVar(&c.FileStoragePath, "f", c.FileStoragePath, "Provide storage file")
+	fs.StringVar((*string)(&c.DatabaseDSN), "d", string(c.DatabaseDSN), "Provide the database dsn connect string")
+	fs.StringVar((*string)(&c.SecretKey), "k", string(c.SecretKey), "Provide the secret key for signing user cookie and hashing client ip, random one is used when not set")
+	fs.StringVar(&c.BlocklistFile, "l", c.BlocklistFile, "Provide the file of blocked domains and url patterns")
+	fs.IntVar(&c.MaxChainDepth, "m", c.MaxChainDepth, "Provide the max depth of own short links resolved to the final url")
+	fs.Var(&c.RateCreate, "rate-create", "Provide the per client limit of creating short urls: requests per second[:burst]")
+	fs.Var(&c.RateRedirect, "rate-redirect", "Provide the per client limit of redirects: requests per second[:burst]")
+	fs.Var(&c.TrustedProxies, "trusted-proxies", "Provide the comma separated proxies trusted to pass the client ip")
+	fs.Var(&c.APIKeys, "api-keys", "Provide the comma separated api keys, rate limited apart from the client ip")
+	fs.BoolVar(&c.EnableHTTPS, "s", c.EnableHTTPS, "Enable https, self-signed certificate is generated when no files provided")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "Provide the tls certificate file")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "Provide the tls key file")
+	fs.BoolVar(&c.SortQuery, "q", c.SortQuery, "Sort query parameters of the url before shortening")
+	fs.IntVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Provide the graceful shutdown timeout, seconds")
+	fs.IntVar(&c.OperationTimeout, "operation-timeout", c.OperationTimeout, "Provide the request operation timeout, seconds")
+	fs.IntVar(&c.ShutdownDrain, "shutdown-drain", c.ShutdownDrain, "Provide the time the server is not ready before it stops accepting on shutdown, seconds")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Provide the log level: trace, debug, info, warn, error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Provide the log format: text or json")
+	fs.StringVar(&c.WALSync, "wal-sync", c.WALSync, "Provide the storage log fsync policy: always, interval or never")
+	fs.IntVar(&c.CompactInterval, "compact-interval", c.CompactInterval, "Provide the interval of compacting the storage log to the storage file, seconds, 0 is on shutdown only")
+	fs.BoolVar(&c.StorageRecover, "storage-recover", c.StorageRecover, "Skip the damaged records of the storage file on restore, they are written to the quarantine file")
+	fs.StringVar(&c.StorageKeyFile, "storage-key-file", c.StorageKeyFile, "Provide the file of the storage encryption keys, id:base64 key per line, the first one encrypts")
+	fs.BoolVar(&c.StorageReencrypt, "storage-reencrypt", c.StorageReencrypt, "Re-encrypt the storage file with the first key and exit")
+	fs.StringVar(&c.ShortGenerator, "short-generator", c.ShortGenerator, "Provide the short code generator: random, sequence, hash or sortable")
+	fs.StringVar(&c.ShortAlphabet, "short-alphabet", c.ShortAlphabet, "Provide the chars of the generated short codes")
+	fs.IntVar(&c.ShortLength, "short-length", c.ShortLength, "Provide the length of the generated short codes")
+	fs.IntVar(&c.KeyPoolSize, "key-pool-size", c.KeyPoolSize, "Provide the size of the pre-generated short codes reserve, 0 is to generate on demand")
+	fs.IntVar(&c.BatchMaxSize, "batch-max-size", c.BatchMaxSize, "Provide the max items count of the batch request, 0 is no limit")
+	return fs
 }
 
 func (c *Config) CleanParameters() *Config {
@@ -64,6 +391,25 @@ func (c *Config) CleanParameters() *Config {
 	c.ServerAddress = strings.TrimPrefix(c.ServerAddress, "https://")
 	c.BaseURL = strings.TrimPrefix(c.BaseURL, "http://")
 	c.BaseURL = strings.TrimPrefix(c.BaseURL, "https://")
-	c.DatabaseDSN = strings.Trim(c.DatabaseDSN, "'")
+	c.DatabaseDSN = Secret(strings.Trim(string(c.DatabaseDSN), "'"))
+	if c.EnableHTTPS {
+		c.Scheme = constant.SchemeHTTPS
+	}
 	return c
 }
+
+func (c *Config) OperationTimeoutDuration() time.Duration {
+	return time.Duration(c.OperationTimeout) * time.Second
+}
+
+func (c *Config) CompactIntervalDuration() time.Duration {
+	return time.Duration(c.CompactInterval) * time.Second
+}
+
+func (c *Config) ShutdownTimeoutDuration() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c *Config) ShutdownDrainDuration() time.Duration {
+	return time.Duration(c.ShutdownDrain) * time.Second
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initConfig runs Init with the flags args, the env and the config file of the content, if any,
+// given by the flag or by the env
+func initConfig(t *testing.T, args []string, env map[string]string, file string, fileByEnv bool) (*Config, error) {
+	t.Helper()
+	// the env of the test run does not leak in, the empty values are not read
+	for _, name := range []string{constant.EnvNameConfig, constant.EnvServerAddressName, constant.EnvNameShutdownTimeout,
+		constant.EnvNameLogFormat, constant.EnvNameBatchMaxSize, constant.EnvNameKeyPoolSize,
+		constant.EnvNameStorageKeys, constant.EnvNameStorageKeyFile} {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	if file != "" {
+		fileName := t.TempDir() + "/config.json"
+		require.NoError(t, os.WriteFile(fileName, []byte(file), 0644))
+		if fileByEnv {
+			t.Setenv(constant.EnvNameConfig, fileName)
+		} else {
+			args = append([]string{"-c", fileName}, args...)
+		}
+	}
+	osArgs := os.Args
+	t.Cleanup(func() { os.Args = osArgs })
+	os.Args = append([]string{"shortener"}, args...)
+	return NewConfig().Init()
+}
+
+func TestConfig_Init(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            []string
+		env             map[string]string
+		file            string
+		fileByEnv       bool
+		serverAddress   string
+		shutdownTimeout int
+	}{
+		{
+			name:            "defaults",
+			serverAddress:   constant.ServerAddress,
+			shutdownTimeout: constant.ServerShutdownTimeout,
+		},
+		{
+			name:            "file over defaults",
+			file:            `{"server_address":"file:8080","shutdown_timeout":5}`,
+			serverAddress:   "file:8080",
+			shutdownTimeout: 5,
+		},
+		{
+			name:            "env over file",
+			env:             map[string]string{constant.EnvServerAddressName: "env:8080", constant.EnvNameShutdownTimeout: "6"},
+			file:            `{"server_address":"file:8080","shutdown_timeout":5}`,
+			serverAddress:   "env:8080",
+			shutdownTimeout: 6,
+		},
+		{
+			name:            "flags over env",
+			args:            []string{"-a", "flag:8080", "-shutdown-timeout", "7"},
+			env:             map[string]string{constant.EnvServerAddressName: "env:8080", constant.EnvNameShutdownTimeout: "6"},
+			file:            `{"server_address":"file:8080","shutdown_timeout":5}`,
+			serverAddress:   "flag:8080",
+			shutdownTimeout: 7,
+		},
+		{
+			name:            "the file fields not set are kept",
+			args:            []string{"-a", "flag:8080"},
+			file:            `{"server_address":"file:8080","shutdown_timeout":5}`,
+			serverAddress:   "flag:8080",
+			shutdownTimeout: 5,
+		},
+		{
+			name:            "re-encrypt with the key file",
+			args:            []string{"-f", "storage.json", "-storage-reencrypt", "-storage-key-file", "storage.keys"},
+			serverAddress:   constant.ServerAddress,
+			shutdownTimeout: constant.ServerShutdownTimeout,
+		},
+		{
+			name:            "config file by env",
+			args:            []string{"-a", "flag:8080"},
+			file:            `{"server_address":"file:8080","shutdown_timeout":5}`,
+			fileByEnv:       true,
+			serverAddress:   "flag:8080",
+			shutdownTimeout: 5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := initConfig(t, test.args, test.env, test.file, test.fileByEnv)
+			require.NoError(t, err)
+			assert.Equal(t, test.serverAddress, c.ServerAddress)
+			assert.Equal(t, test.shutdownTimeout, c.ShutdownTimeout)
+		})
+	}
+}
+
+func TestConfig_InitInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		file   string
+		errors []string
+	}{
+		{
+			name:   "unknown file key",
+			file:   `{"server_adress":"file:8080"}`,
+			errors: []string{`unknown field "server_adress"`},
+		},
+		{
+			name:   "bad file value",
+			file:   `{"shutdown_timeout":"5s"}`,
+			errors: []string{"shutdown_timeout: json: cannot unmarshal"},
+		},
+		{
+			name:   "re-encrypt with no keys",
+			args:   []string{"-f", "storage.json", "-storage-reencrypt"},
+			errors: []string{"storage keys are required to re-encrypt"},
+		},
+		{
+			name: "all invalid fields at once",
+			args: []string{"-key-pool-size", "-1"},
+			env:  map[string]string{constant.EnvNameBatchMaxSize: "many"},
+			file: `{"shutdown_timeout":0,"log_format":"xml","unknown":1}`,
+			errors: []string{
+				"key_pool_size: must not be negative",
+				"env " + constant.EnvNameBatchMaxSize + ":",
+				"shutdown_timeout: must be positive",
+				`log_format: "xml" is not one of`,
+				`unknown field "unknown"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := initConfig(t, test.args, test.env, test.file, false)
+			require.Error(t, err)
+			for _, e := range test.errors {
+				assert.ErrorContains(t, err, e)
+			}
+		})
+	}
+}
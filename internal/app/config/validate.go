@@ -0,0 +1,94 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Validate checks all the settings and reports every invalid one
+func (c *Config) Validate() error {
+	errs := append([]error{}, c.errs...)
+	invalid := func(field, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, a...)...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ServerAddress); err != nil {
+		invalid("server_address", "%v", err)
+	}
+	if u, err := url.Parse(c.Scheme + c.BaseURL); err != nil || u.Host == "" {
+		invalid("base_url", "%q is not a valid host", c.BaseURL)
+	}
+	if c.MaxChainDepth < 0 {
+		invalid("max_chain_depth", "must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		invalid("shutdown_timeout", "must be positive")
+	}
+	if c.ShutdownDrain < 0 {
+		invalid("shutdown_drain", "must not be negative")
+	}
+	if c.OperationTimeout <= 0 {
+		invalid("operation_timeout", "must be positive")
+	}
+	for _, l := range []struct {
+		field string
+		limit RateLimit
+	}{{"rate_limit_create", c.RateCreate}, {"rate_limit_redirect", c.RateRedirect}} {
+		if l.limit.Rate < 0 || (l.limit.Rate > 0 && l.limit.Burst < 1) {
+			invalid(l.field, "%q is not a valid limit", l.limit.String())
+		}
+	}
+	for _, p := range c.TrustedProxies {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				invalid("trusted_proxies", "%q is not an ip or cidr", p)
+			}
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		invalid("tls_cert_file", "tls_cert_file and tls_key_file are set together")
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		invalid("log_level", "%v", err)
+	}
+	if c.LogFormat != constant.LogFormatText && c.LogFormat != constant.LogFormatJSON {
+		invalid("log_format", "%q is not one of %s, %s", c.LogFormat, constant.LogFormatText, constant.LogFormatJSON)
+	}
+	switch c.WALSync {
+	case constant.WALSyncAlways, constant.WALSyncInterval, constant.WALSyncNever:
+	default:
+		invalid("wal_sync", "%q is not one of %s, %s, %s", c.WALSync, constant.WALSyncAlways, constant.WALSyncInterval, constant.WALSyncNever)
+	}
+	if c.CompactInterval < 0 {
+		invalid("compact_interval", "must not be negative")
+	}
+	if c.StorageKeys != "" && c.StorageKeyFile != "" {
+		invalid("storage_key_file", "storage keys are set by env %s or the key file, not both", constant.EnvNameStorageKeys)
+	} else if _, err := keyring.Parse(string(c.StorageKeys)); err != nil {
+		invalid(constant.EnvNameStorageKeys, "%v", err)
+	}
+	if _, err := shortcode.New(c.ShortGenerator, c.ShortAlphabet, c.ShortLength); err != nil {
+		invalid("short_generator", "%v", err)
+	}
+	if c.BatchMaxSize < 0 {
+		invalid("batch_max_size", "must not be negative")
+	}
+	if c.KeyPoolSize < 0 {
+		invalid("key_pool_size", "must not be negative")
+	}
+	if c.StorageReencrypt && c.FileStoragePath == "" {
+		invalid("file_storage_path", "is required to re-encrypt")
+	}
+	if c.StorageReencrypt && c.StorageKeys == "" && c.StorageKeyFile == "" {
+		invalid("storage_key_file", "storage keys are required to re-encrypt, by env %s or the key file", constant.EnvNameStorageKeys)
+	}
+	return errors.Join(errs...)
+}
@@ -3,22 +3,136 @@ package constant
 const (
 	ServerShutdownTimeout  = 30
 	ServerOperationTimeout = 30
+	ServerShutdownDrain    = 5
+
+	DeleteFlushInterval = 1
+	DeleteBatchSize     = 100
+	DeleteQueueSize     = 1000
+
+	ClickFlushInterval = 5
+	ClickBatchSize     = 500
+	ClickQueueSize     = 10000
+	ClickFileSuffix    = ".clicks"
+	ClickMemMaxCount   = 100000
+
+	WALFileSuffix    = ".wal"
+	WALRotatedSuffix = ".1"
+	WALSyncAlways    = "always"
+	WALSyncInterval  = "interval"
+	WALSyncNever     = "never"
+	WALSyncPeriod    = 1
+	WALSync          = WALSyncAlways
+	CompactInterval  = 300
+
+	StorageFormat           = "shortener-storage"
+	StorageVersion          = 2
+	StorageQuarantineSuffix = ".quarantine"
+
+	StatsTopSize       = 10
+	StatsBucketHour    = "hour"
+	StatsBucketDay     = "day"
+	StatsBucketDefault = StatsBucketDay
+
+	ReaperInterval = 60
+
+	MemShards = 64
+
+	KeyPoolSize           = 1000
+	KeyPoolRefillInterval = 1
+
+	ShortGeneratorRandom   = "random"
+	ShortGeneratorSequence = "sequence"
+	ShortGeneratorHash     = "hash"
+	ShortGeneratorSortable = "sortable"
+	ShortGenerator         = ShortGeneratorRandom
+	ShortAlphabet          = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	BlocklistReloadInterval = 30
+
+	HealthCheckTimeout = 2
+
+	CertReloadInterval = 10
+	SelfSignedCertTTL  = 24 * 365
+
+	RateLimitIdleTTL      = 600
+	RateLimitAPIKeyHeader = "X-API-Key"
 
 	Scheme          = "http://"
+	SchemeHTTPS     = "https://"
 	ServerAddress   = "localhost:8080"
 	BaseURL         = "localhost:8080"
 	FileStoragePath = "/tmp/short-url-db.json"
 
-	EnvServerAddressName   = "SERVER_ADDRESS"
-	EnvBaseURLName         = "BASE_URL"
-	EnvFileStoragePathName = "FILE_STORAGE_PATH"
-	EnvNameDBDSN           = "DATABASE_DSN"
+	EnvServerAddressName    = "SERVER_ADDRESS"
+	EnvBaseURLName          = "BASE_URL"
+	EnvFileStoragePathName  = "FILE_STORAGE_PATH"
+	EnvNameDBDSN            = "DATABASE_DSN"
+	EnvNameSecretKey        = "SECRET_KEY"
+	EnvNameSortQuery        = "SORT_QUERY"
+	EnvNameBlocklistFile    = "BLOCKLIST_FILE"
+	EnvNameMaxChainDepth    = "MAX_CHAIN_DEPTH"
+	EnvNameRateCreate       = "RATE_LIMIT_CREATE"
+	EnvNameRateRedirect     = "RATE_LIMIT_REDIRECT"
+	EnvNameTrustedProxies   = "TRUSTED_PROXIES"
+	EnvNameAPIKeys          = "API_KEYS"
+	EnvNameEnableHTTPS      = "ENABLE_HTTPS"
+	EnvNameTLSCertFile      = "TLS_CERT_FILE"
+	EnvNameTLSKeyFile       = "TLS_KEY_FILE"
+	EnvNameConfig           = "CONFIG"
+	EnvNameShutdownTimeout  = "SHUTDOWN_TIMEOUT"
+	EnvNameOperationTimeout = "OPERATION_TIMEOUT"
+	EnvNameShutdownDrain    = "SHUTDOWN_DRAIN"
+	EnvNameLogLevel         = "LOG_LEVEL"
+	EnvNameLogFormat        = "LOG_FORMAT"
+	EnvNameWALSync          = "WAL_SYNC"
+	EnvNameCompactInterval  = "COMPACT_INTERVAL"
+	EnvNameStorageRecover   = "STORAGE_RECOVER"
+	EnvNameStorageKeys      = "STORAGE_KEYS"
+	EnvNameStorageKeyFile   = "STORAGE_KEY_FILE"
+	EnvNameShortGenerator   = "SHORT_GENERATOR"
+	EnvNameShortAlphabet    = "SHORT_ALPHABET"
+	EnvNameShortLength      = "SHORT_LENGTH"
+	EnvNameKeyPoolSize      = "KEY_POOL_SIZE"
+	EnvNameBatchMaxSize     = "BATCH_MAX_SIZE"
+
+	ShortLen    = 8
+	ShortMinLen = 4
+	AliasMinLen = 3
+	AliasMaxLen = 32
+	URLMaxLen   = 2048
 
-	ShortLen = 8
+	MaxChainDepth = 5
 
+	BatchMaxSize = 10000
+	// BatchItemMaxBytes bounds the json of the batch item, the url with the alias, the correlation id and the expiry
+	BatchItemMaxBytes = 4 * URLMaxLen
+
+	PingRoute    = "/ping"
+	MetricsRoute = "/metrics"
+	WarningRoute = "/warning"
+	HealthzRoute = "/healthz"
+	ReadyzRoute  = "/readyz"
 	APIRoute     = "/api"
 	ShortenRoute = "/shorten"
 	BatchRoute   = "/batch"
+	StatsRoute   = "/stats"
+	UserRoute    = "/user"
+	URLsRoute    = "/urls"
+
+	CookieUserName       = "user"
+	CookieUserMaxAge     = 365 * 24 * 60 * 60
+	ContextUserValueName = "userID"
+	ContextUserIsNewName = "userIsNew"
+
+	RequestIDHeader = "X-Request-ID"
+	RequestIDMaxLen = 128
+
+	LogLevel      = "info"
+	LogFormatText = "text"
+	LogFormatJSON = "json"
 
-	DBTableName = "shortener"
+	DBTableName           = "shortener"
+	DBShortConstraintName = "shortener_short"
+	DBClicksTableName     = "clicks"
+	DBShortKeysTableName  = "short_keys"
 )
@@ -1,23 +1,144 @@
 package domain
 
+import "time"
+
+// CreateURL is the input for a new short link. ExpiresIn is ttl in seconds,
+// ExpiresAt is an absolute expiry time, they are mutually exclusive
 type CreateURL struct {
-	URL string `json:"url"`
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty" validate:"omitempty,alias"`
+	ExpiresIn int64      `json:"expires_in,omitempty" validate:"omitempty,gt=0"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" validate:"omitempty,gt,excluded_with=ExpiresIn"`
 }
 
 type ResultURL struct {
 	Result string `json:"result"`
 }
 
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Readiness is the result of the dependency checks, latency is in milliseconds
+type Readiness struct {
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// BlockedResult is the machine-readable refusal of the blocked url
+type BlockedResult struct {
+	Error         string `json:"error"`
+	Reason        string `json:"reason"`
+	Rule          string `json:"rule,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
 type ShortBatchInputItem struct {
-	CorrelationID string `json:"correlation_id" validate:"required"`
-	OriginalURL   string `json:"original_url" validate:"required"`
+	CorrelationID string     `json:"correlation_id" validate:"required"`
+	OriginalURL   string     `json:"original_url" validate:"required"`
+	Alias         string     `json:"alias,omitempty" validate:"omitempty,alias"`
+	ExpiresIn     int64      `json:"expires_in,omitempty" validate:"omitempty,gt=0"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty" validate:"omitempty,gt,excluded_with=ExpiresIn"`
+}
+
+// ShortBatchQuery is the mode of the batch, Partial makes the result of the every item apart
+type ShortBatchQuery struct {
+	Partial bool `form:"partial"`
 }
 
 type ShortBatchInput struct {
 	List []ShortBatchInputItem `validate:"required,gt=0,dive"`
 }
 
+// the codes of the batch item errors
+const (
+	BatchErrInvalid      = "invalid"
+	BatchErrInvalidURL   = "invalid_url"
+	BatchErrBlocked      = "blocked"
+	BatchErrAliasTaken   = "alias_taken"
+	BatchErrAlreadyExist = "already_exist"
+)
+
+// ShortBatchItemError is the machine-readable failure of the batch item, Reason and Rule are of the blocked url
+type ShortBatchItemError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// ShortBatchResultItem is the short of the batch item. In the partial mode the failed item has Error instead,
+// the url stored before has both
 type ShortBatchResultItem struct {
-	CorrelationTD string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	CorrelationTD string               `json:"correlation_id"`
+	ShortURL      string               `json:"short_url,omitempty"`
+	Error         *ShortBatchItemError `json:"error,omitempty"`
+	// Err is the failure of the item, made into Error by the handler
+	Err error `json:"-"`
+}
+
+type ShortBatchSummary struct {
+	Total   int `json:"total"`
+	Created int `json:"created"`
+	Existed int `json:"existed"`
+	Failed  int `json:"failed"`
+}
+
+// ShortBatchPartialResult is the result of the batch in the partial mode
+type ShortBatchPartialResult struct {
+	Items   []ShortBatchResultItem `json:"items"`
+	Summary ShortBatchSummary      `json:"summary"`
+}
+
+type UserURLItem struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+type DeleteURLItem struct {
+	UserID string
+	Short  string
+}
+
+// Click is a redirect event, client ip is stored hashed
+type Click struct {
+	Time      time.Time `json:"time"`
+	Short     string    `json:"short"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+}
+
+// StatsQuery limits click statistics to [From, To) grouped by Bucket: hour or day
+type StatsQuery struct {
+	From   time.Time `form:"from"`
+	To     time.Time `form:"to" validate:"omitempty,gtfield=From"`
+	Bucket string    `form:"bucket" validate:"omitempty,oneof=hour day"`
+}
+
+type Stats struct {
+	Total         int64        `json:"total"`
+	Unique        int64        `json:"unique"`
+	Series        []StatsPoint `json:"series"`
+	TopReferrers  []StatsTop   `json:"top_referrers"`
+	TopUserAgents []StatsTop   `json:"top_user_agents"`
+}
+
+type StatsPoint struct {
+	Time   time.Time `json:"time"`
+	Clicks int64     `json:"clicks"`
+}
+
+type StatsTop struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
 }
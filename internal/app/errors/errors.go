@@ -5,6 +5,44 @@ import (
 )
 
 var (
-	ErrNotExist     = errors.New("does not exist")
-	ErrAlreadyExist = errors.New("already exist")
+	ErrNotExist      = errors.New("does not exist")
+	ErrAlreadyExist  = errors.New("already exist")
+	ErrAliasTaken    = errors.New("alias already taken")
+	ErrIsDeleted     = errors.New("is deleted")
+	ErrExpired       = errors.New("is expired")
+	ErrShutdown      = errors.New("service is shutting down")
+	ErrInvalidURL    = errors.New("invalid url")
+	ErrBlocked       = errors.New("url is blocked")
+	ErrRedirectLoop  = errors.New("redirect loop")
+	ErrDamagedRecord = errors.New("damaged record")
+	ErrBatchTooLarge = errors.New("batch is too large")
 )
+
+// BlockedError is returned by url checkers for the refused url.
+// Reason is machine-readable, Rule is the blocklist entry matched
+type BlockedError struct {
+	Reason string
+	Rule   string
+}
+
+func (e *BlockedError) Error() string {
+	return ErrBlocked.Error() + ": " + e.Reason + " " + e.Rule
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// BatchItemError binds the error to the batch item
+type BatchItemError struct {
+	CorrelationID string
+	Err           error
+}
+
+func (e *BatchItemError) Error() string {
+	return e.CorrelationID + ": " + e.Err.Error()
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
@@ -2,10 +2,13 @@ package handler
 
 import (
 	"compress/gzip"
-	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
 	"net/http"
 
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
 	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/middleware"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/service"
 
@@ -15,30 +18,66 @@ import (
 
 type Handler struct {
 	s   service.Service
+	c   *config.Config
 	r   *gin.Engine
 	log *logrus.Logger
 }
 
-func NewHandler(s service.Service) *Handler { return &Handler{s: s} }
+func NewHandler(s service.Service, c *config.Config, log *logrus.Logger) *Handler {
+	return &Handler{s: s, c: c, log: log}
+}
+
+// logger is the log of the request served
+func (h *Handler) logger(c *gin.Context) logrus.FieldLogger {
+	return logger.WithRequestID(c, h.log)
+}
 
 func (h *Handler) Handler() http.Handler {
 	h.r = gin.New()
-	h.r.Use(logger.Logger())
+	// the request context values, as the request id, are reached through the gin context passed down
+	h.r.ContextWithFallback = true
+	h.r.Use(middleware.RequestID())
+	h.r.Use(logger.Logger(h.log))
+	h.r.Use(metrics.Middleware())
 	h.r.Use(middleware.Compress(gzip.DefaultCompression, h.log))
 	h.r.Use(middleware.Decompress(h.log))
+	h.r.Use(middleware.Auth(string(h.c.SecretKey), h.c.EnableHTTPS))
+
+	if err := h.r.SetTrustedProxies(h.c.TrustedProxies); err != nil {
+		h.log.WithError(err).Error("Trusted proxies")
+	}
+	createLimit := middleware.RateLimit(newLimiter(h.c.RateCreate), h.c.APIKeys)
+	redirectLimit := middleware.RateLimit(newLimiter(h.c.RateRedirect), h.c.APIKeys)
 
 	h.r.NoRoute(func(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 	})
 	rootRoute := h.r.Group("/")
-	rootRoute.POST("", h.MakeShort())
-	rootRoute.GET("/ping", h.GetDBPing())
-	rootRoute.GET("/:id", h.GetShort())
+	rootRoute.POST("", createLimit, h.MakeShort())
+	rootRoute.GET(constant.PingRoute, h.GetDBPing())
+	rootRoute.GET(constant.MetricsRoute, metrics.Handler(metrics.Default))
+	rootRoute.GET(constant.HealthzRoute, h.GetHealthz())
+	rootRoute.GET(constant.ReadyzRoute, h.GetReadyz())
+	rootRoute.GET("/:id", redirectLimit, h.GetShort())
+	rootRoute.GET(constant.WarningRoute+"/:id", h.GetWarning())
 
 	apiRoute := rootRoute.Group(constant.APIRoute)
 	shortAPIRoute := apiRoute.Group(constant.ShortenRoute)
-	shortAPIRoute.POST("", h.MakeShortJSON())
-	shortAPIRoute.POST(constant.BatchRoute, h.MakeShortBatch())
+	shortAPIRoute.POST("", createLimit, h.MakeShortJSON())
+	shortAPIRoute.POST(constant.BatchRoute, createLimit, h.MakeShortBatch())
+	shortAPIRoute.GET("/:id"+constant.StatsRoute, h.GetStats())
+
+	userAPIRoute := apiRoute.Group(constant.UserRoute)
+	userAPIRoute.GET(constant.URLsRoute, h.GetUserURLs())
+	userAPIRoute.DELETE(constant.URLsRoute, h.DeleteUserURLs())
 
 	return h.r
 }
+
+// newLimiter is nil for no limit
+func newLimiter(l config.RateLimit) *middleware.Limiter {
+	if l.Rate <= 0 {
+		return nil
+	}
+	return middleware.NewLimiter(l.Rate, l.Burst)
+}
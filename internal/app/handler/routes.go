@@ -2,13 +2,16 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"time"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
 	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -24,15 +27,23 @@ func (h *Handler) MakeShort() func(c *gin.Context) {
 		}
 		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
-			h.log.WithField("Error", err).Error("Error get body")
+			h.logger(c).WithField("Error", err).Error("Error get body")
 			return
 		}
 		var html string
-		ctx, cancel := context.WithTimeout(c, constant.ServerOperationTimeout*time.Second)
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
 		defer cancel()
-		if html, err = h.s.NewShort(ctx, string(url)); err != nil && !errors.Is(err, myErr.ErrAlreadyExist) {
+		if html, err = h.s.NewShort(ctx, domain.CreateURL{URL: string(url)}); err != nil && !errors.Is(err, myErr.ErrAlreadyExist) {
+			if errors.Is(err, myErr.ErrInvalidURL) {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			if blocked, ok := blockedResult(err); ok {
+				c.JSON(http.StatusUnprocessableEntity, blocked)
+				return
+			}
 			c.AbortWithStatus(http.StatusInternalServerError)
-			h.log.WithField("Error", err).Error("Error create new short")
+			h.logger(c).WithField("Error", err).Error("Error create new short")
 		}
 		c.Header("Content-Type", "text/plain; charset=utf-8")
 		status := http.StatusCreated
@@ -60,11 +71,22 @@ func (h *Handler) MakeShortJSON() func(c *gin.Context) {
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
-		ctx, cancel := context.WithTimeout(c, constant.ServerOperationTimeout*time.Second)
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
 		defer cancel()
-		if result.Result, err = h.s.NewShort(ctx, url.URL); err != nil && !errors.Is(err, myErr.ErrAlreadyExist) {
-			c.AbortWithStatus(http.StatusInternalServerError)
-			h.log.WithField("Error", err).Error("Error create new short")
+		if result.Result, err = h.s.NewShort(ctx, url); err != nil && !errors.Is(err, myErr.ErrAlreadyExist) {
+			switch {
+			case errors.As(err, &validator.ValidationErrors{}), errors.Is(err, myErr.ErrInvalidURL):
+				c.String(http.StatusBadRequest, err.Error())
+			case errors.Is(err, myErr.ErrAliasTaken):
+				c.String(http.StatusConflict, err.Error())
+			case errors.Is(err, myErr.ErrBlocked):
+				blocked, _ := blockedResult(err)
+				c.JSON(http.StatusUnprocessableEntity, blocked)
+			default:
+				c.AbortWithStatus(http.StatusInternalServerError)
+				h.logger(c).WithField("Error", err).Error("Error create new short")
+			}
+			return
 		}
 		status := http.StatusCreated
 		if errors.Is(err, myErr.ErrAlreadyExist) {
@@ -79,27 +101,51 @@ func (h *Handler) MakeShortBatch() func(c *gin.Context) {
 		var (
 			input  []domain.ShortBatchInputItem
 			result []domain.ShortBatchResultItem
+			q      domain.ShortBatchQuery
 			err    error
-			body   []byte
 		)
 
-		if body, err = c.GetRawData(); err != nil || len(body) == 0 {
-			c.AbortWithStatus(http.StatusBadRequest)
+		if err = c.ShouldBindQuery(&q); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		if err = ffjson.NewDecoder().Decode(body, &input); err != nil {
-			c.AbortWithStatus(http.StatusBadRequest)
+		body := c.Request.Body
+		if h.c.BatchMaxSize > 0 {
+			body = http.MaxBytesReader(c.Writer, body, int64(h.c.BatchMaxSize+1)*constant.BatchItemMaxBytes)
+		}
+		if input, err = decodeBatch(body, h.c.BatchMaxSize); err != nil {
+			var maxBytes *http.MaxBytesError
+			if errors.Is(err, myErr.ErrBatchTooLarge) {
+				c.String(http.StatusRequestEntityTooLarge, err.Error())
+			} else if errors.As(err, &maxBytes) {
+				c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("%s: over %d bytes", myErr.ErrBatchTooLarge, maxBytes.Limit))
+			} else {
+				c.AbortWithStatus(http.StatusBadRequest)
+			}
 			return
 		}
-		ctx, cancel := context.WithTimeout(c, constant.ServerOperationTimeout*time.Second)
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
 		defer cancel()
+		if q.Partial {
+			h.makeShortBatchPartial(ctx, c, input)
+			return
+		}
 		if result, err = h.s.NewShortBatch(ctx, input); err != nil {
-			if errors.As(err, &validator.ValidationErrors{}) {
+			if errors.As(err, &validator.ValidationErrors{}) || errors.Is(err, myErr.ErrInvalidURL) {
 				c.String(http.StatusBadRequest, err.Error())
 				return
+			} else if errors.Is(err, myErr.ErrAliasTaken) {
+				c.String(http.StatusConflict, err.Error())
+				return
+			} else if errors.Is(err, myErr.ErrBatchTooLarge) {
+				c.String(http.StatusRequestEntityTooLarge, err.Error())
+				return
+			} else if blocked, ok := blockedResult(err); ok {
+				c.JSON(http.StatusUnprocessableEntity, blocked)
+				return
 			} else {
 				c.AbortWithStatus(http.StatusInternalServerError)
-				h.log.WithField("Error", err).Error("Error create new batch shorts")
+				h.logger(c).WithField("Error", err).Error("Error create new batch shorts")
 				return
 			}
 		}
@@ -107,35 +153,251 @@ func (h *Handler) MakeShortBatch() func(c *gin.Context) {
 	}
 }
 
+var errNotBatch = errors.New("batch is not the json array")
+
+// decodeBatch reads the items of the json array, the max items are read at most, so the large batch
+// is rejected before it is read whole. The max 0 is no limit
+func decodeBatch(r io.Reader, max int) (input []domain.ShortBatchInputItem, err error) {
+	dec := json.NewDecoder(r)
+	var t json.Token
+	if t, err = dec.Token(); err != nil {
+		return
+	}
+	if t != json.Delim('[') {
+		return nil, errNotBatch
+	}
+	for dec.More() {
+		if max > 0 && len(input) == max {
+			return nil, fmt.Errorf("%w: more than %d items", myErr.ErrBatchTooLarge, max)
+		}
+		var item domain.ShortBatchInputItem
+		if err = dec.Decode(&item); err != nil {
+			return nil, err
+		}
+		input = append(input, item)
+	}
+	_, err = dec.Token()
+	return
+}
+
+// makeShortBatchPartial responds 207 with the result of the every item and their summary
+func (h *Handler) makeShortBatchPartial(ctx context.Context, c *gin.Context, input []domain.ShortBatchInputItem) {
+	items, err := h.s.NewShortBatchPartial(ctx, input)
+	if err != nil {
+		if errors.As(err, &validator.ValidationErrors{}) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else if errors.Is(err, myErr.ErrBatchTooLarge) {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+		} else {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			h.logger(c).WithField("Error", err).Error("Error create new batch shorts")
+		}
+		return
+	}
+	result := domain.ShortBatchPartialResult{
+		Items:   items,
+		Summary: domain.ShortBatchSummary{Total: len(items)},
+	}
+	for i := range result.Items {
+		item := &result.Items[i]
+		switch {
+		case item.Err == nil:
+			result.Summary.Created++
+		case errors.Is(item.Err, myErr.ErrAlreadyExist):
+			result.Summary.Existed++
+		default:
+			result.Summary.Failed++
+		}
+		if item.Err != nil {
+			item.Error = batchItemError(item.Err)
+		}
+	}
+	c.JSON(http.StatusMultiStatus, result)
+}
+
+// batchItemError makes the machine-readable error of the batch item
+func batchItemError(err error) *domain.ShortBatchItemError {
+	var (
+		itemErr = &domain.ShortBatchItemError{Message: err.Error()}
+		item    *myErr.BatchItemError
+		blocked *myErr.BlockedError
+	)
+	// the correlation id is in the result already
+	if errors.As(err, &item) {
+		itemErr.Message = item.Err.Error()
+	}
+	switch {
+	case errors.As(err, &validator.ValidationErrors{}):
+		itemErr.Code = domain.BatchErrInvalid
+	case errors.Is(err, myErr.ErrInvalidURL):
+		itemErr.Code = domain.BatchErrInvalidURL
+	case errors.As(err, &blocked):
+		itemErr.Code, itemErr.Reason, itemErr.Rule = domain.BatchErrBlocked, blocked.Reason, blocked.Rule
+	case errors.Is(err, myErr.ErrAliasTaken):
+		itemErr.Code = domain.BatchErrAliasTaken
+	case errors.Is(err, myErr.ErrAlreadyExist):
+		itemErr.Code = domain.BatchErrAlreadyExist
+	}
+	return itemErr
+}
+
 func (h *Handler) GetShort() func(c *gin.Context) {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(c, constant.ServerOperationTimeout*time.Second)
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
 		defer cancel()
 		if newURL, err := h.s.GetFromShort(ctx, c.Param("id")); err != nil {
 			if errors.Is(err, myErr.ErrNotExist) {
+				metrics.Redirects.Inc(metrics.RedirectMiss)
 				c.AbortWithStatus(http.StatusBadRequest)
+			} else if errors.Is(err, myErr.ErrIsDeleted) || errors.Is(err, myErr.ErrExpired) {
+				metrics.Redirects.Inc(metrics.RedirectGone)
+				c.AbortWithStatus(http.StatusGone)
+			} else if errors.Is(err, myErr.ErrBlocked) {
+				metrics.Redirects.Inc(metrics.RedirectBlocked)
+				c.Redirect(http.StatusTemporaryRedirect, constant.WarningRoute+"/"+c.Param("id"))
 			} else {
 				c.AbortWithStatus(http.StatusInternalServerError)
-				h.log.WithField("Error", err).Error("Error get new short")
+				h.logger(c).WithField("Error", err).Error("Error get new short")
 			}
 			return
 		} else {
+			metrics.Redirects.Inc(metrics.RedirectHit)
+			h.s.Click(c.Param("id"), c.Request.Referer(), c.Request.UserAgent(), c.ClientIP())
 			c.Redirect(http.StatusTemporaryRedirect, newURL)
 			return
 		}
 	}
 }
 
+func (h *Handler) GetUserURLs() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if c.GetBool(constant.ContextUserIsNewName) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
+		defer cancel()
+		result, err := h.s.GetUserURLs(ctx)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			h.logger(c).WithField("Error", err).Error("Error get user urls")
+			return
+		}
+		if len(result) == 0 {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+func (h *Handler) DeleteUserURLs() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if c.GetBool(constant.ContextUserIsNewName) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		var (
+			shorts []string
+			err    error
+			body   []byte
+		)
+		if body, err = c.GetRawData(); err != nil || len(body) == 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if err = ffjson.NewDecoder().Decode(body, &shorts); err != nil || len(shorts) == 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
+		defer cancel()
+		if err = h.s.DeleteUserURLs(ctx, shorts); err != nil {
+			if errors.Is(err, myErr.ErrShutdown) {
+				c.AbortWithStatus(http.StatusServiceUnavailable)
+			} else {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				h.logger(c).WithField("Error", err).Error("Error delete user urls")
+			}
+			return
+		}
+		c.Status(http.StatusAccepted)
+	}
+}
+
+func (h *Handler) GetStats() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var q domain.StatsQuery
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
+		defer cancel()
+		stats, err := h.s.GetStats(ctx, c.Param("id"), q)
+		if err != nil {
+			if errors.As(err, &validator.ValidationErrors{}) {
+				c.String(http.StatusBadRequest, err.Error())
+			} else if errors.Is(err, myErr.ErrNotExist) {
+				c.AbortWithStatus(http.StatusNotFound)
+			} else {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				h.logger(c).WithField("Error", err).Error("Error get stats")
+			}
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	}
+}
+
 func (h *Handler) GetDBPing() func(c *gin.Context) {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(c, constant.ServerOperationTimeout*time.Second)
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
 		defer cancel()
 
 		if err := h.s.CheckDB(ctx); err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
-			h.log.Error("Error ", err)
+			h.logger(c).Error("Error ", err)
 		} else {
 			c.String(http.StatusOK, "Status: ok")
 		}
 	}
 }
+
+// GetHealthz reports the process is alive, no dependencies are checked
+func (h *Handler) GetHealthz() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": domain.StatusOK})
+	}
+}
+
+// GetReadyz reports the dependency checks, not ready is 503
+func (h *Handler) GetReadyz() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		result, ready := h.s.Ready(c)
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+			h.logger(c).WithField("readiness", result).Warn("Not ready")
+		}
+		c.JSON(status, result)
+	}
+}
+
+// blockedResult makes the response for the url refused by the checkers
+func blockedResult(err error) (result domain.BlockedResult, ok bool) {
+	var blocked *myErr.BlockedError
+	if ok = errors.As(err, &blocked); !ok {
+		return
+	}
+	result = domain.BlockedResult{
+		Error:  myErr.ErrBlocked.Error(),
+		Reason: blocked.Reason,
+		Rule:   blocked.Rule,
+	}
+	var item *myErr.BatchItemError
+	if errors.As(err, &item) {
+		result.CorrelationID = item.CorrelationID
+	}
+	return
+}
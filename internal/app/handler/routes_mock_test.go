@@ -3,6 +3,7 @@ package handler
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
@@ -13,10 +14,11 @@ import (
 	"testing"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
 	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
-	"github.com/MrSwed/go-musthave-shortener/internal/app/helper"
 	mocks "github.com/MrSwed/go-musthave-shortener/internal/app/mock/repository"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/service"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -28,8 +30,8 @@ func TestHandler_MockGetShort(t *testing.T) {
 	defer ctrl.Finish()
 	repo := mocks.NewMockRepository(ctrl)
 	conf := config.NewConfig()
-	s := service.NewService(repo, conf)
-	h := NewHandler(s).Handler()
+	s := service.NewService(repo, conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
@@ -38,12 +40,17 @@ func TestHandler_MockGetShort(t *testing.T) {
 	testURL1 := "https://practicum.yandex.ru/"
 	testURL2 := "https://practicum2.yandex.ru/"
 
-	testShort1 := helper.NewRandShorter().RandStringBytes().String()
-	testShort2 := helper.NewRandShorter().RandStringBytes().String()
+	testShort1 := shortcode.Default().Generate("", 0)
+	testShort2 := shortcode.Default().Generate("", 0)
 
 	_ = repo.EXPECT().GetFromShort(gomock.Any(), testShort1).Return(testURL1, nil).AnyTimes()
 	_ = repo.EXPECT().GetFromShort(gomock.Any(), testShort2).Return(testURL2, nil).AnyTimes()
 	_ = repo.EXPECT().GetFromShort(gomock.Any(), gomock.Any()).Return("", myErr.ErrNotExist).AnyTimes()
+	var clicks []domain.Click
+	_ = repo.EXPECT().SaveClicks(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, c []domain.Click) error {
+		clicks = append(clicks, c...)
+		return nil
+	}).AnyTimes()
 
 	type want struct {
 		code            int
@@ -156,6 +163,13 @@ func TestHandler_MockGetShort(t *testing.T) {
 			}
 		})
 	}
+
+	// flush the click queue
+	require.NoError(t, s.Clicker.Close(context.TODO()))
+	require.Len(t, clicks, 2)
+	assert.Equal(t, testShort1, clicks[0].Short)
+	assert.Equal(t, testShort2, clicks[1].Short)
+	assert.NotEmpty(t, clicks[0].IPHash)
 }
 
 func TestHandler_MockMakeShort(t *testing.T) {
@@ -163,17 +177,17 @@ func TestHandler_MockMakeShort(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	repo := mocks.NewMockRepository(ctrl)
-	s := service.NewService(repo, conf)
-	h := NewHandler(s).Handler()
+	s := service.NewService(repo, conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
 	// save some values
 	testURL := "https://practicum.yandex.ru/"
-	testShortURL := helper.NewRandShorter().RandStringBytes().String()
+	testShortURL := shortcode.Default().Generate("", 0)
 
-	_ = repo.EXPECT().NewShort(gomock.Any(), testURL).Return(testShortURL, nil).AnyTimes()
+	_ = repo.EXPECT().NewShort(gomock.Any(), domain.CreateURL{URL: testURL}).Return(testShortURL, nil).AnyTimes()
 	_ = repo.EXPECT().GetFromURL(gomock.Any(), testURL).Return("", nil).AnyTimes()
 
 	type want struct {
@@ -253,8 +267,8 @@ func TestHandler_MockMakeShortJSON(t *testing.T) {
 	defer ctrl.Finish()
 	repo := mocks.NewMockRepository(ctrl)
 
-	s := service.NewService(repo, conf)
-	h := NewHandler(s).Handler()
+	s := service.NewService(repo, conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
@@ -262,10 +276,10 @@ func TestHandler_MockMakeShortJSON(t *testing.T) {
 	// save some values
 	testURL := "https://practicum.yandex.ru/"
 
-	testShortURL := helper.NewRandShorter().RandStringBytes().String()
+	testShortURL := shortcode.Default().Generate("", 0)
 
-	_ = repo.EXPECT().NewShort(gomock.Any(), testURL).Return(testShortURL, nil).AnyTimes()
-	_ = repo.EXPECT().NewShort(gomock.Any(), gomock.Any()).Return(helper.NewRandShorter().RandStringBytes().String(), nil).AnyTimes()
+	_ = repo.EXPECT().NewShort(gomock.Any(), domain.CreateURL{URL: testURL}).Return(testShortURL, nil).AnyTimes()
+	_ = repo.EXPECT().NewShort(gomock.Any(), gomock.Any()).Return(shortcode.Default().Generate("", 0), nil).AnyTimes()
 	_ = repo.EXPECT().GetFromURL(gomock.Any(), gomock.Any()).Return("", nil).AnyTimes()
 
 	type want struct {
@@ -7,21 +7,32 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
-	"github.com/MrSwed/go-musthave-shortener/internal/app/helper"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/service"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
 
+	"github.com/google/uuid"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	logTest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -37,11 +48,12 @@ func NewTestConfig() (c *config.Config) {
 	c.BaseURL = baseURL
 	c.FileStoragePath = fileStoragePath
 	c.DatabaseDSN = databaseDSN
+	c.SecretKey = "test-secret-key"
 	c.WithEnv().CleanParameters()
 
 	var err error
 	if c.DatabaseDSN != "" {
-		if db, err = sqlx.Open("pgx", c.DatabaseDSN); err != nil {
+		if db, err = sqlx.Open("pgx", string(c.DatabaseDSN)); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -49,13 +61,15 @@ func NewTestConfig() (c *config.Config) {
 }
 
 var (
-	conf = NewTestConfig()
-	db   *sqlx.DB
+	conf       = NewTestConfig()
+	db         *sqlx.DB
+	testLogger = logrus.StandardLogger()
 )
 
 func TestHandler_GetShort(t *testing.T) {
-	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf)
-	h := NewHandler(s).Handler()
+	r := repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db})
+	s := service.NewService(r, conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
@@ -63,12 +77,16 @@ func TestHandler_GetShort(t *testing.T) {
 	// save some values
 	testURL1 := "https://practicum.yandex.ru/"
 	testURL2 := "https://practicum2.yandex.ru/"
+	testURLExpired := "https://practicum.yandex.ru/?expired" + shortcode.Default().Generate("", 0)
 	localURL := "http://" + baseURL + "/"
 	ctx := context.TODO()
-	testShort1, _ := s.NewShort(ctx, testURL1)
-	testShort2, _ := s.NewShort(ctx, testURL2)
+	testShort1, _ := s.NewShort(ctx, domain.CreateURL{URL: testURL1})
+	testShort2, _ := s.NewShort(ctx, domain.CreateURL{URL: testURL2})
 	testShort1 = strings.ReplaceAll(testShort1, localURL, "")
 	testShort2 = strings.ReplaceAll(testShort2, localURL, "")
+	expired := time.Now().Add(-time.Minute)
+	testShortExpired, err := r.NewShort(ctx, domain.CreateURL{URL: testURLExpired, ExpiresAt: &expired})
+	require.NoError(t, err)
 	type want struct {
 		code            int
 		responseContain string
@@ -137,6 +155,16 @@ func TestHandler_GetShort(t *testing.T) {
 				contentType:     "text/html; charset=utf-8",
 			},
 		},
+		{
+			name: "Get expired",
+			args: args{
+				method: http.MethodGet,
+				path:   "/" + testShortExpired,
+			},
+			want: want{
+				code: http.StatusGone,
+			},
+		},
 		{
 			name: "PUT some. Wrong method 2",
 			args: args{
@@ -183,18 +211,18 @@ func TestHandler_GetShort(t *testing.T) {
 }
 
 func TestHandler_MakeShort(t *testing.T) {
-	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf)
-	h := NewHandler(s).
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).
 		Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
 	// save some values
-	testURL := "https://practicum.yandex.ru/?rand_Hash" + helper.NewRandShorter().RandStringBytes().String()
+	testURL := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
 	testURLExist := "https://practicum.yandex.ru/?exist"
 	ctx := context.TODO()
-	_, _ = s.NewShort(ctx, testURLExist)
+	_, _ = s.NewShort(ctx, domain.CreateURL{URL: testURLExist})
 
 	type want struct {
 		code            int
@@ -245,6 +273,66 @@ func TestHandler_MakeShort(t *testing.T) {
 				responseContain: conf.BaseURL,
 			},
 		},
+		{
+			name: "Post Main exist, not canonical",
+			args: args{
+				method: http.MethodPost,
+				path:   "/",
+				data:   "HTTPS://Practicum.Yandex.RU:443?exist",
+			},
+			want: want{
+				code:            http.StatusConflict,
+				responseContain: conf.BaseURL,
+			},
+		},
+		{
+			name: "Post Main not url",
+			args: args{
+				method: http.MethodPost,
+				path:   "/",
+				data:   "hello",
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "scheme is required",
+			},
+		},
+		{
+			name: "Post Main wrong scheme",
+			args: args{
+				method: http.MethodPost,
+				path:   "/",
+				data:   "ftp://practicum.yandex.ru/",
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "is not allowed",
+			},
+		},
+		{
+			name: "Post Main no host",
+			args: args{
+				method: http.MethodPost,
+				path:   "/",
+				data:   "http:///path",
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "host is required",
+			},
+		},
+		{
+			name: "Post Main too long",
+			args: args{
+				method: http.MethodPost,
+				path:   "/",
+				data:   "https://practicum.yandex.ru/" + strings.Repeat("a", constant.URLMaxLen),
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "is longer than",
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -280,19 +368,25 @@ func TestHandler_MakeShort(t *testing.T) {
 }
 
 func TestHandler_MakeShortJSON(t *testing.T) {
-	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf)
-	h := NewHandler(s).Handler()
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
-	testURL := "https://practicum.yandex.ru/?rand_Hash" + helper.NewRandShorter().RandStringBytes().String()
-	testURL1 := "https://practicum.yandex.ru/?rand_Hash" + helper.NewRandShorter().RandStringBytes().String()
-	testURL2 := "https://practicum.yandex.ru/?rand_Hash" + helper.NewRandShorter().RandStringBytes().String()
-	testURL3 := "https://practicum.yandex.ru/?rand_Hash" + helper.NewRandShorter().RandStringBytes().String()
+	testURL := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL1 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL2 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL3 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL4 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL5 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL6 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testURL7 := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testAlias := "spring-sale_" + shortcode.Default().Generate("", 0)
+	testIDNQuery := "rand_Hash" + shortcode.Default().Generate("", 0)
 	testURLExist := "https://practicum.yandex.ru/?exist"
 	ctx := context.TODO()
-	_, _ = s.NewShort(ctx, testURLExist)
+	_, _ = s.NewShort(ctx, domain.CreateURL{URL: testURLExist})
 
 	type want struct {
 		code            int
@@ -338,6 +432,158 @@ func TestHandler_MakeShortJSON(t *testing.T) {
 				contentType:     "application/json; charset=utf-8",
 			},
 		},
+		{
+			name: "Create new shorten by JSON, idn host",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url": "https://xn--e1afmkfd.xn--p1ai/?" + testIDNQuery,
+				},
+			},
+			want: want{
+				code:            http.StatusCreated,
+				responseContain: conf.BaseURL,
+				contentType:     "application/json; charset=utf-8",
+			},
+		},
+		{
+			name: "Create new exist by JSON, idn host unicode",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url": "https://ПРИМЕР.рф?" + testIDNQuery,
+				},
+			},
+			want: want{
+				code:            http.StatusConflict,
+				responseContain: conf.BaseURL,
+				contentType:     "application/json; charset=utf-8",
+			},
+		},
+		{
+			name: "Create new shorten by JSON, not url",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url": "hello",
+				},
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "invalid url",
+			},
+		},
+		{
+			name: "Create new shorten with ttl",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]interface{}{
+					"url":        testURL6,
+					"expires_in": 3600,
+				},
+			},
+			want: want{
+				code:            http.StatusCreated,
+				responseContain: conf.BaseURL,
+				contentType:     "application/json; charset=utf-8",
+			},
+		},
+		{
+			name: "Create new shorten with expiry",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]interface{}{
+					"url":        testURL7,
+					"expires_at": time.Now().Add(time.Hour),
+				},
+			},
+			want: want{
+				code:            http.StatusCreated,
+				responseContain: conf.BaseURL,
+				contentType:     "application/json; charset=utf-8",
+			},
+		},
+		{
+			name: "Create new shorten with expiry in the past",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]interface{}{
+					"url":        testURL5,
+					"expires_at": time.Now().Add(-time.Hour),
+				},
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Create new shorten with both ttl and expiry",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]interface{}{
+					"url":        testURL5,
+					"expires_in": 3600,
+					"expires_at": time.Now().Add(time.Hour),
+				},
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Create new shorten with alias",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url":   testURL4,
+					"alias": testAlias,
+				},
+			},
+			want: want{
+				code:            http.StatusCreated,
+				responseContain: conf.BaseURL + "/" + testAlias,
+				contentType:     "application/json; charset=utf-8",
+			},
+		},
+		{
+			name: "Create new shorten with taken alias",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url":   testURL5,
+					"alias": testAlias,
+				},
+			},
+			want: want{
+				code: http.StatusConflict,
+			},
+		},
+		{
+			name: "Create new shorten with wrong alias",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url":   testURL5,
+					"alias": "spring sale",
+				},
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Create new shorten with reserved alias",
+			args: args{
+				method: http.MethodPost,
+				data: map[string]string{
+					"url":   testURL5,
+					"alias": "api",
+				},
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
 		{
 			name: "Post No body",
 			args: args{
@@ -508,8 +754,8 @@ func TestHandler_MakeShortJSON(t *testing.T) {
 	}
 }
 func TestHandler_MakeShortBatch(t *testing.T) {
-	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf)
-	h := NewHandler(s).Handler()
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
 
 	ts := httptest.NewServer(h)
 	defer ts.Close()
@@ -653,3 +899,1217 @@ func TestHandler_MakeShortBatch(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_GetUserURLs(t *testing.T) {
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	testURL := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	userURL := ts.URL + constant.APIRoute + constant.UserRoute + constant.URLsRoute
+
+	// user with one url
+	res, err := http.Post(ts.URL+"/", "text/plain", strings.NewReader(testURL))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	userCookies := res.Cookies()
+	require.NotEmpty(t, userCookies)
+
+	// user without urls
+	res, err = http.Get(userURL)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	emptyCookies := res.Cookies()
+	require.NotEmpty(t, emptyCookies)
+
+	type want struct {
+		code            int
+		responseContain string
+		contentType     string
+	}
+	type args struct {
+		cookies []*http.Cookie
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "User urls",
+			args: args{
+				cookies: userCookies,
+			},
+			want: want{
+				code:            http.StatusOK,
+				responseContain: testURL,
+				contentType:     "application/json; charset=utf-8",
+			},
+		},
+		{
+			name: "User without urls",
+			args: args{
+				cookies: emptyCookies,
+			},
+			want: want{
+				code: http.StatusNoContent,
+			},
+		},
+		{
+			name: "No cookie",
+			want: want{
+				code: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "Wrong sign cookie",
+			args: args{
+				cookies: []*http.Cookie{{Name: constant.CookieUserName, Value: "00000000-0000-0000-0000-000000000000.wrong"}},
+			},
+			want: want{
+				code: http.StatusUnauthorized,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, userURL, nil)
+			require.NoError(t, err)
+			for _, cookie := range test.args.cookies {
+				req.AddCookie(cookie)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() {
+				err := res.Body.Close()
+				require.NoError(t, err)
+			}()
+
+			require.Equal(t, test.want.code, res.StatusCode)
+			resBody, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+
+			if test.want.responseContain != "" {
+				assert.Contains(t, string(resBody), test.want.responseContain)
+			}
+			if test.want.contentType != "" {
+				assert.Equal(t, test.want.contentType, res.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandler_DeleteUserURLs(t *testing.T) {
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	testURL := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	userURL := ts.URL + constant.APIRoute + constant.UserRoute + constant.URLsRoute
+	localURL := "http://" + baseURL + "/"
+
+	res, err := http.Post(ts.URL+"/", "text/plain", strings.NewReader(testURL))
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	userCookies := res.Cookies()
+	testShort := strings.ReplaceAll(string(body), localURL, "")
+
+	type want struct {
+		code int
+	}
+	type args struct {
+		cookies []*http.Cookie
+		data    interface{}
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "No cookie",
+			args: args{
+				data: []string{testShort},
+			},
+			want: want{
+				code: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "Wrong json body",
+			args: args{
+				cookies: userCookies,
+				data:    map[string]string{"short": testShort},
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Wrong sign cookie",
+			args: args{
+				cookies: []*http.Cookie{{Name: constant.CookieUserName, Value: "wrong"}},
+				data:    []string{testShort},
+			},
+			want: want{
+				code: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "Delete accepted",
+			args: args{
+				cookies: userCookies,
+				data:    []string{testShort},
+			},
+			want: want{
+				code: http.StatusAccepted,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			err := json.NewEncoder(b).Encode(test.args.data)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodDelete, userURL, b)
+			require.NoError(t, err)
+			for _, cookie := range test.args.cookies {
+				req.AddCookie(cookie)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, test.want.code, res.StatusCode)
+		})
+	}
+
+	// flush the delete queue
+	require.NoError(t, s.Deleter.Close(context.TODO()))
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+testShort, nil)
+	require.NoError(t, err)
+	res, err = http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusGone, res.StatusCode)
+}
+
+func TestHandler_GetStats(t *testing.T) {
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	start := time.Now().Add(-time.Second).UTC()
+	testURL := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+	testReferrer := "https://referrer.example/"
+	localURL := "http://" + baseURL + "/"
+	testShort, err := s.NewShort(context.TODO(), domain.CreateURL{URL: testURL})
+	require.NoError(t, err)
+	testShort = strings.ReplaceAll(testShort, localURL, "")
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+testShort, nil)
+		require.NoError(t, err)
+		req.Header.Set("Referer", testReferrer)
+		res, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+	}
+	// flush the click queue
+	require.NoError(t, s.Clicker.Close(context.TODO()))
+
+	statsURL := ts.URL + constant.APIRoute + constant.ShortenRoute + "/" + testShort + constant.StatsRoute
+	from := start.Format(time.RFC3339)
+
+	type want struct {
+		code   int
+		total  int64
+		unique int64
+		series int
+	}
+	type args struct {
+		short string
+		query string
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "Stats by day",
+			args: args{
+				query: "?from=" + from,
+			},
+			want: want{
+				code:   http.StatusOK,
+				total:  2,
+				unique: 1,
+				series: 1,
+			},
+		},
+		{
+			name: "Stats by hour",
+			args: args{
+				query: "?bucket=hour&from=" + from,
+			},
+			want: want{
+				code:   http.StatusOK,
+				total:  2,
+				unique: 1,
+				series: 1,
+			},
+		},
+		{
+			name: "Stats in the past",
+			args: args{
+				query: "?to=" + from,
+			},
+			want: want{
+				code: http.StatusOK,
+			},
+		},
+		{
+			name: "Wrong bucket",
+			args: args{
+				query: "?bucket=week",
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Wrong time",
+			args: args{
+				query: "?from=yesterday",
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "From after to",
+			args: args{
+				query: "?from=" + from + "&to=" + start.Add(-time.Hour).Format(time.RFC3339),
+			},
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Unknown short",
+			args: args{
+				short: "unknown" + shortcode.Default().Generate("", 0),
+			},
+			want: want{
+				code: http.StatusNotFound,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := statsURL
+			if test.args.short != "" {
+				url = ts.URL + constant.APIRoute + constant.ShortenRoute + "/" + test.args.short + constant.StatsRoute
+			}
+			res, err := http.Get(url + test.args.query)
+			require.NoError(t, err)
+			defer func() {
+				err := res.Body.Close()
+				require.NoError(t, err)
+			}()
+
+			require.Equal(t, test.want.code, res.StatusCode)
+			if test.want.code != http.StatusOK {
+				return
+			}
+			var stats domain.Stats
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+			assert.Equal(t, test.want.total, stats.Total)
+			assert.Equal(t, test.want.unique, stats.Unique)
+			assert.Len(t, stats.Series, test.want.series)
+			if test.want.total > 0 {
+				require.NotEmpty(t, stats.TopReferrers)
+				assert.Equal(t, testReferrer, stats.TopReferrers[0].Value)
+				assert.Equal(t, test.want.total, stats.TopReferrers[0].Clicks)
+			}
+		})
+	}
+}
+
+func TestHandler_GetMetrics(t *testing.T) {
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger)
+	h := NewHandler(s, conf, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	for _, path := range []string{constant.PingRoute, "/not-exist-short"} {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+
+	res, err := http.Get(ts.URL + constant.MetricsRoute)
+	require.NoError(t, err)
+	defer func() {
+		err := res.Body.Close()
+		require.NoError(t, err)
+	}()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "text/plain")
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	for _, want := range []string{
+		"# TYPE shortener_http_requests_total counter",
+		`shortener_http_requests_total{route="` + constant.PingRoute + `",method="GET",status="200"}`,
+		`shortener_http_request_duration_seconds_bucket{route="/:id",method="GET",status="400",le="+Inf"}`,
+		"# TYPE shortener_redirects_total counter",
+		`shortener_redirects_total{result="miss"}`,
+		"# TYPE shortener_short_collisions_total counter",
+		"# TYPE shortener_file_save_duration_seconds histogram",
+	} {
+		assert.Contains(t, string(body), want)
+	}
+}
+
+func TestHandler_Blocklist(t *testing.T) {
+	blocklistFile := t.TempDir() + "/blocklist.txt"
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("# test rules\nblocked.example\nre:[?&]malware=\n"), 0644))
+	blocklist, err := service.NewBlocklistChecker(blocklistFile, testLogger)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, blocklist.Close(context.TODO()))
+	}()
+
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), conf, testLogger, blocklist)
+	h := NewHandler(s, conf, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	testHost := "later-" + strings.ToLower(shortcode.Default().Generate("", 0)) + ".example"
+	localURL := "http://" + baseURL + "/"
+	testShort, err := s.NewShort(context.TODO(), domain.CreateURL{URL: "https://" + testHost + "/"})
+	require.NoError(t, err)
+	testShort = strings.ReplaceAll(testShort, localURL, "")
+
+	type want struct {
+		code          int
+		reason        string
+		correlationID string
+	}
+	type args struct {
+		path string
+		data interface{}
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "Blocked domain",
+			args: args{
+				path: constant.APIRoute + constant.ShortenRoute,
+				data: map[string]string{"url": "https://blocked.example/path"},
+			},
+			want: want{
+				code:   http.StatusUnprocessableEntity,
+				reason: service.BlockReasonDomain,
+			},
+		},
+		{
+			name: "Blocked subdomain",
+			args: args{
+				path: constant.APIRoute + constant.ShortenRoute,
+				data: map[string]string{"url": "https://WWW.Blocked.Example/"},
+			},
+			want: want{
+				code:   http.StatusUnprocessableEntity,
+				reason: service.BlockReasonDomain,
+			},
+		},
+		{
+			name: "Blocked pattern",
+			args: args{
+				path: constant.APIRoute + constant.ShortenRoute,
+				data: map[string]string{"url": "https://practicum.yandex.ru/?malware=1"},
+			},
+			want: want{
+				code:   http.StatusUnprocessableEntity,
+				reason: service.BlockReasonPattern,
+			},
+		},
+		{
+			name: "Blocked in batch",
+			args: args{
+				path: constant.APIRoute + constant.ShortenRoute + constant.BatchRoute,
+				data: []map[string]string{
+					{"correlation_id": "1", "original_url": "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)},
+					{"correlation_id": "2", "original_url": "https://blocked.example/"},
+				},
+			},
+			want: want{
+				code:          http.StatusUnprocessableEntity,
+				reason:        service.BlockReasonDomain,
+				correlationID: "2",
+			},
+		},
+		{
+			name: "Not blocked",
+			args: args{
+				path: constant.APIRoute + constant.ShortenRoute,
+				data: map[string]string{"url": "https://not-blocked.example/?rand_Hash" + shortcode.Default().Generate("", 0)},
+			},
+			want: want{
+				code: http.StatusCreated,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := json.Marshal(test.args.data)
+			require.NoError(t, err)
+			res, err := http.Post(ts.URL+test.args.path, "application/json", bytes.NewReader(body))
+			require.NoError(t, err)
+			defer func() {
+				err := res.Body.Close()
+				require.NoError(t, err)
+			}()
+
+			require.Equal(t, test.want.code, res.StatusCode)
+			if test.want.reason == "" {
+				return
+			}
+			var result domain.BlockedResult
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+			assert.Equal(t, test.want.reason, result.Reason)
+			assert.Equal(t, test.want.correlationID, result.CorrelationID)
+		})
+	}
+
+	t.Run("Existing link blocked later", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+testShort, nil)
+		require.NoError(t, err)
+		res, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+		assert.Equal(t, "https://"+testHost+"/", res.Header.Get("Location"))
+
+		require.NoError(t, os.WriteFile(blocklistFile, []byte("blocked.example\n"+testHost+"\n"), 0644))
+		require.NoError(t, os.Chtimes(blocklistFile, time.Now(), time.Now().Add(time.Minute)))
+		reloaded, err := blocklist.Reload()
+		require.NoError(t, err)
+		require.True(t, reloaded)
+
+		res, err = http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+		assert.Equal(t, constant.WarningRoute+"/"+testShort, res.Header.Get("Location"))
+
+		res, err = http.Get(ts.URL + constant.WarningRoute + "/" + testShort)
+		require.NoError(t, err)
+		defer func() {
+			err := res.Body.Close()
+			require.NoError(t, err)
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		page, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(page), testHost)
+	})
+}
+
+func TestHandler_MakeShortOwnURL(t *testing.T) {
+	c := *conf
+	c.MaxChainDepth = 2
+	r := repository.NewRepository(repository.Config{StorageFile: c.FileStoragePath, DB: db})
+	s := service.NewService(r, &c, testLogger)
+	h := NewHandler(s, &c, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	ctx := context.TODO()
+	localURL := "http://" + baseURL + "/"
+	rand := shortcode.Default().Generate("", 0)
+	testShort, err := s.NewShort(ctx, domain.CreateURL{URL: "https://practicum.yandex.ru/?rand_Hash" + rand})
+	require.NoError(t, err)
+	testShort = strings.ReplaceAll(testShort, localURL, "")
+
+	// chains and loops stored before, bypassing the service
+	chain1, err := r.NewShort(ctx, domain.CreateURL{URL: localURL + testShort, Alias: "chain1-" + rand})
+	require.NoError(t, err)
+	chain2, err := r.NewShort(ctx, domain.CreateURL{URL: localURL + chain1, Alias: "chain2-" + rand})
+	require.NoError(t, err)
+	_, err = r.NewShort(ctx, domain.CreateURL{URL: localURL + "loop2-" + rand, Alias: "loop1-" + rand})
+	require.NoError(t, err)
+	_, err = r.NewShort(ctx, domain.CreateURL{URL: localURL + "loop1-" + rand, Alias: "loop2-" + rand})
+	require.NoError(t, err)
+
+	type want struct {
+		code            int
+		responseContain string
+	}
+	type args struct {
+		url   string
+		alias string
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "Own short link resolved to exist",
+			args: args{
+				url: "HTTP://" + strings.ToUpper(baseURL) + "/" + testShort,
+			},
+			want: want{
+				code:            http.StatusConflict,
+				responseContain: localURL + testShort,
+			},
+		},
+		{
+			name: "Own short links chain resolved to exist",
+			args: args{
+				url: localURL + chain1,
+			},
+			want: want{
+				code:            http.StatusConflict,
+				responseContain: localURL + testShort,
+			},
+		},
+
+		{
+			name: "Own short links chain too deep",
+			args: args{
+				url: localURL + chain2,
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "deeper than 2",
+			},
+		},
+		{
+			name: "Own short links loop",
+			args: args{
+				url: localURL + "loop1-" + rand,
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "redirect loop",
+			},
+		},
+		{
+			name: "Link to itself",
+			args: args{
+				url:   localURL + "self-" + rand,
+				alias: "self-" + rand,
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "redirect loop",
+			},
+		},
+		{
+			name: "Own short link not exist",
+			args: args{
+				url: localURL + "not-exist-" + rand,
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "does not exist",
+			},
+		},
+		{
+			name: "Own url not a short link",
+			args: args{
+				url: localURL + strings.TrimPrefix(constant.APIRoute+constant.ShortenRoute, "/"),
+			},
+			want: want{
+				code:            http.StatusBadRequest,
+				responseContain: "not a short link",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := json.Marshal(domain.CreateURL{URL: test.args.url, Alias: test.args.alias})
+			require.NoError(t, err)
+			res, err := http.Post(ts.URL+constant.APIRoute+constant.ShortenRoute, "application/json", bytes.NewReader(body))
+			require.NoError(t, err)
+			resBody, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+
+			require.Equal(t, test.want.code, res.StatusCode)
+			assert.Contains(t, string(resBody), test.want.responseContain)
+		})
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	c := *conf
+	c.RateCreate = config.RateLimit{Rate: 0.1, Burst: 2}
+	c.RateRedirect = config.RateLimit{Rate: 0.1, Burst: 1}
+	c.APIKeys = config.SecretList{"test-key"}
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: c.FileStoragePath, DB: db}), &c, testLogger)
+	h := NewHandler(s, &c, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	testShort, err := s.NewShort(context.TODO(), domain.CreateURL{URL: "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)})
+	require.NoError(t, err)
+	testShort = strings.ReplaceAll(testShort, "http://"+baseURL+"/", "")
+
+	type want struct {
+		code       int
+		remaining  string
+		retryAfter bool
+	}
+	type args struct {
+		method string
+		path   string
+		apiKey string
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "Create first",
+			args: args{method: http.MethodPost, path: "/"},
+			want: want{code: http.StatusCreated, remaining: "1"},
+		},
+		{
+			name: "Create second",
+			args: args{method: http.MethodPost, path: constant.APIRoute + constant.ShortenRoute},
+			want: want{code: http.StatusCreated, remaining: "0"},
+		},
+		{
+			name: "Create limited",
+			args: args{method: http.MethodPost, path: "/"},
+			want: want{code: http.StatusTooManyRequests, remaining: "0", retryAfter: true},
+		},
+		{
+			name: "Create with api key",
+			args: args{method: http.MethodPost, path: "/", apiKey: "test-key"},
+			want: want{code: http.StatusCreated, remaining: "1"},
+		},
+		{
+			name: "Create with unknown api key",
+			args: args{method: http.MethodPost, path: "/", apiKey: "unknown-key"},
+			want: want{code: http.StatusTooManyRequests, remaining: "0", retryAfter: true},
+		},
+		{
+			name: "Redirect first",
+			args: args{method: http.MethodGet, path: "/" + testShort},
+			want: want{code: http.StatusTemporaryRedirect, remaining: "0"},
+		},
+		{
+			name: "Redirect limited",
+			args: args{method: http.MethodGet, path: "/" + testShort},
+			want: want{code: http.StatusTooManyRequests, remaining: "0", retryAfter: true},
+		},
+		{
+			name: "Not limited route",
+			args: args{method: http.MethodGet, path: constant.PingRoute},
+			want: want{code: http.StatusOK},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body io.Reader
+			if test.args.method == http.MethodPost {
+				data := "https://practicum.yandex.ru/?rand_Hash" + shortcode.Default().Generate("", 0)
+				if test.args.path != "/" {
+					data = `{"url":"` + data + `"}`
+				}
+				body = strings.NewReader(data)
+			}
+			req, err := http.NewRequest(test.args.method, ts.URL+test.args.path, body)
+			require.NoError(t, err)
+			if test.args.apiKey != "" {
+				req.Header.Set(constant.RateLimitAPIKeyHeader, test.args.apiKey)
+			}
+			res, err := http.DefaultTransport.RoundTrip(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+
+			require.Equal(t, test.want.code, res.StatusCode)
+			assert.Equal(t, test.want.remaining, res.Header.Get("X-RateLimit-Remaining"))
+			if test.want.retryAfter {
+				assert.NotEmpty(t, res.Header.Get("Retry-After"))
+				assert.NotEmpty(t, res.Header.Get("X-RateLimit-Reset"))
+			}
+		})
+	}
+}
+
+func TestHandler_RequestID(t *testing.T) {
+	l, err := logger.New("info", constant.LogFormatJSON)
+	require.NoError(t, err)
+	l.SetOutput(io.Discard)
+	hook := logTest.NewLocal(l)
+
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db, Log: l}), conf, l)
+	h := NewHandler(s, conf, l).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{
+			name:      "Request id passed",
+			requestID: "test-request-" + shortcode.Default().Generate("", 0),
+		},
+		{
+			name: "Request id issued",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+constant.PingRoute, nil)
+			require.NoError(t, err)
+			if test.requestID != "" {
+				req.Header.Set(constant.RequestIDHeader, test.requestID)
+			}
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			requestID := res.Header.Get(constant.RequestIDHeader)
+			require.NotEmpty(t, requestID)
+			if test.requestID != "" {
+				assert.Equal(t, test.requestID, requestID)
+			}
+			// the request is logged after the response is sent
+			assert.Eventually(t, func() bool {
+				for _, entry := range hook.AllEntries() {
+					if entry.Message == "Served" && entry.Data["request_id"] == requestID {
+						return true
+					}
+				}
+				return false
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestHandler_RequestIDStorageLog(t *testing.T) {
+	l, err := logger.New("debug", constant.LogFormatJSON)
+	require.NoError(t, err)
+	l.SetOutput(io.Discard)
+	hook := logTest.NewLocal(l)
+
+	gen, err := shortcode.New(constant.ShortGeneratorHash, "0123456789abcdef", 12)
+	require.NoError(t, err)
+	c := *conf
+	c.DatabaseDSN = ""
+	c.FileStoragePath = ""
+	s := service.NewService(repository.NewRepository(repository.Config{Generator: gen, Log: l}), &c, l)
+	ts := httptest.NewServer(NewHandler(s, &c, l).Handler())
+	defer ts.Close()
+
+	shorten := func(body, requestID string) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+constant.APIRoute+constant.ShortenRoute, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(constant.RequestIDHeader, requestID)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	testURL := "https://practicum.yandex.ru/?request-id" + shortcode.Default().Generate("", 0)
+	// the alias takes the first code of the url, so the storage retries on the collision
+	shorten(`{"url":"`+testURL+`/alias","alias":"`+gen.Generate(testURL, 0)+`"}`, "test-request-alias")
+	shorten(`{"url":"`+testURL+`"}`, "test-request-collision")
+
+	var found bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Short collision, retry" {
+			found = true
+			assert.Equal(t, "test-request-collision", entry.Data["request_id"])
+		}
+	}
+	assert.True(t, found, "the storage logs the collision")
+}
+
+func TestHandler_Readiness(t *testing.T) {
+	c := *conf
+	c.FileStoragePath = t.TempDir() + "/storage.json"
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: c.FileStoragePath, DB: db}), &c, testLogger)
+	h := NewHandler(s, &c, testLogger).Handler()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	get := func(path string) (int, domain.Readiness) {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, res.Body.Close())
+		}()
+		var result domain.Readiness
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return res.StatusCode, result
+	}
+	checks := func(r domain.Readiness) map[string]string {
+		m := make(map[string]string)
+		for _, c := range r.Checks {
+			m[c.Name] = c.Status
+		}
+		return m
+	}
+
+	code, result := get(constant.HealthzRoute)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, domain.StatusOK, result.Status)
+
+	code, result = get(constant.ReadyzRoute)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, domain.StatusOK, result.Status)
+	assert.Equal(t, map[string]string{
+		"storage":      domain.StatusOK,
+		"file_storage": domain.StatusOK,
+		"deleter":      domain.StatusOK,
+		"clicker":      domain.StatusOK,
+		"reaper":       domain.StatusOK,
+		"compactor":    domain.StatusOK,
+	}, checks(result))
+
+	s.ShuttingDown()
+	code, result = get(constant.ReadyzRoute)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, domain.StatusFail, result.Status)
+	assert.Equal(t, domain.StatusOK, checks(result)["deleter"])
+
+	require.NoError(t, s.Deleter.Close(context.TODO()))
+	code, result = get(constant.ReadyzRoute)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, domain.StatusFail, checks(result)["deleter"])
+
+	code, _ = get(constant.HealthzRoute)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestHandler_ConcurrentDedupe(t *testing.T) {
+	s := service.NewService(repository.NewRepository(repository.Config{DB: db}), conf, testLogger)
+	testURL := "https://practicum.yandex.ru/?dedupe" + shortcode.Default().Generate("", 0)
+
+	const n = 32
+	var (
+		wg      sync.WaitGroup
+		shorts  = make([]string, n)
+		errs    = make([]error, n)
+		start   = make(chan struct{})
+		created int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			shorts[i], errs[i] = s.NewShort(context.TODO(), domain.CreateURL{URL: testURL})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] == nil {
+			created++
+		} else {
+			assert.ErrorIs(t, errs[i], myErr.ErrAlreadyExist)
+		}
+		assert.Equal(t, shorts[0], shorts[i])
+	}
+	assert.Equal(t, 1, created)
+}
+
+func TestHandler_BatchLimit(t *testing.T) {
+	c := *conf
+	c.BatchMaxSize = 3
+	s := service.NewService(repository.NewRepository(repository.Config{StorageFile: conf.FileStoragePath, DB: db}), &c, testLogger)
+	ts := httptest.NewServer(NewHandler(s, &c, testLogger).Handler())
+	defer ts.Close()
+	testURL := "https://practicum.yandex.ru/?batch" + shortcode.Default().Generate("", 0)
+
+	post := func(items []domain.ShortBatchInputItem) (*http.Response, []byte) {
+		b, err := json.Marshal(items)
+		require.NoError(t, err)
+		res, err := http.Post(ts.URL+constant.APIRoute+constant.ShortenRoute+constant.BatchRoute, "application/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, res.Body.Close()) }()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, body
+	}
+
+	t.Run("over the max size", func(t *testing.T) {
+		items := make([]domain.ShortBatchInputItem, c.BatchMaxSize+1)
+		for i := range items {
+			items[i] = domain.ShortBatchInputItem{CorrelationID: fmt.Sprint(i), OriginalURL: fmt.Sprintf("%s%d", testURL, i)}
+		}
+		res, body := post(items)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+		assert.Contains(t, string(body), myErr.ErrBatchTooLarge.Error())
+	})
+
+	t.Run("over the max bytes", func(t *testing.T) {
+		items := []domain.ShortBatchInputItem{{
+			CorrelationID: strings.Repeat("c", (c.BatchMaxSize+1)*constant.BatchItemMaxBytes),
+			OriginalURL:   testURL + "bytes",
+		}}
+		res, body := post(items)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+		assert.Contains(t, string(body), myErr.ErrBatchTooLarge.Error())
+	})
+
+	t.Run("the items over the max size are not read", func(t *testing.T) {
+		var body strings.Builder
+		body.WriteString("[")
+		for i := 0; i <= c.BatchMaxSize; i++ {
+			fmt.Fprintf(&body, `{"correlation_id":"%d","original_url":"%s%d"},`, i, testURL, i)
+		}
+		_, err := decodeBatch(io.MultiReader(strings.NewReader(body.String()), iotest.ErrReader(errors.New("read on"))), c.BatchMaxSize)
+		assert.ErrorIs(t, err, myErr.ErrBatchTooLarge)
+	})
+
+	t.Run("not the array", func(t *testing.T) {
+		res, err := http.Post(ts.URL+constant.APIRoute+constant.ShortenRoute+constant.BatchRoute, "application/json",
+			strings.NewReader(`{"correlation_id":"1","original_url":"`+testURL+`"}`))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("in the input order, the repeated url gets the one short", func(t *testing.T) {
+		items := []domain.ShortBatchInputItem{
+			{CorrelationID: "c", OriginalURL: testURL + "c"},
+			{CorrelationID: "a", OriginalURL: testURL + "a"},
+			{CorrelationID: "b", OriginalURL: testURL + "c"},
+		}
+		res, body := post(items)
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+		var result []domain.ShortBatchResultItem
+		require.NoError(t, json.Unmarshal(body, &result))
+		require.Len(t, result, len(items))
+		for i := range items {
+			assert.Equal(t, items[i].CorrelationID, result[i].CorrelationTD)
+		}
+		assert.Equal(t, result[0].ShortURL, result[2].ShortURL)
+		assert.NotEqual(t, result[0].ShortURL, result[1].ShortURL)
+	})
+}
+
+func TestHandler_BatchPartial(t *testing.T) {
+	s := service.NewService(repository.NewRepository(repository.Config{DB: db}), conf, testLogger)
+	ts := httptest.NewServer(NewHandler(s, conf, testLogger).Handler())
+	defer ts.Close()
+	testURL := "https://practicum.yandex.ru/?partial" + shortcode.Default().Generate("", 0)
+	alias := "p" + shortcode.Default().Generate("", 0)
+
+	existed, err := s.NewShort(context.TODO(), domain.CreateURL{URL: testURL + "existed", Alias: alias})
+	require.NoError(t, err)
+
+	items := []domain.ShortBatchInputItem{
+		{CorrelationID: "new", OriginalURL: testURL + "new"},
+		{CorrelationID: "existed", OriginalURL: testURL + "existed"},
+		{CorrelationID: "invalid url", OriginalURL: "ftp://practicum.yandex.ru/"},
+		{CorrelationID: "alias taken", OriginalURL: testURL + "alias", Alias: alias},
+		{CorrelationID: "no url"},
+		{CorrelationID: "repeated", OriginalURL: testURL + "new"},
+	}
+	b, err := json.Marshal(items)
+	require.NoError(t, err)
+	res, err := http.Post(ts.URL+constant.APIRoute+constant.ShortenRoute+constant.BatchRoute+"?partial=true", "application/json", bytes.NewReader(b))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, res.Body.Close()) }()
+	require.Equal(t, http.StatusMultiStatus, res.StatusCode)
+
+	var result domain.ShortBatchPartialResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.Equal(t, domain.ShortBatchSummary{Total: 6, Created: 1, Existed: 2, Failed: 3}, result.Summary)
+	require.Len(t, result.Items, len(items))
+	codes := make(map[string]string)
+	for i, item := range result.Items {
+		assert.Equal(t, items[i].CorrelationID, item.CorrelationTD)
+		if item.Error != nil {
+			codes[item.CorrelationTD] = item.Error.Code
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"existed":     domain.BatchErrAlreadyExist,
+		"invalid url": domain.BatchErrInvalidURL,
+		"alias taken": domain.BatchErrAliasTaken,
+		"no url":      domain.BatchErrInvalid,
+		"repeated":    domain.BatchErrAlreadyExist,
+	}, codes)
+	assert.NotEmpty(t, result.Items[0].ShortURL)
+	assert.Equal(t, existed, result.Items[1].ShortURL)
+	assert.Equal(t, result.Items[0].ShortURL, result.Items[5].ShortURL)
+	assert.Empty(t, result.Items[3].ShortURL)
+
+	t.Run("bad mode", func(t *testing.T) {
+		res, err := http.Post(ts.URL+constant.APIRoute+constant.ShortenRoute+constant.BatchRoute+"?partial=maybe", "application/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestHandler_ReshortenDeleted(t *testing.T) {
+	r := repository.NewRepository(repository.Config{DB: db})
+	s := service.NewService(r, conf, testLogger)
+	ts := httptest.NewServer(NewHandler(s, conf, testLogger).Handler())
+	defer ts.Close()
+	testURL := "https://practicum.yandex.ru/?deleted" + shortcode.Default().Generate("", 0)
+	localURL := "http://" + baseURL + "/"
+	userID := uuid.New().String()
+
+	short, err := s.NewShort(context.WithValue(context.TODO(), constant.ContextUserValueName, userID), domain.CreateURL{URL: testURL})
+	require.NoError(t, err)
+	short = strings.TrimPrefix(short, localURL)
+	require.NoError(t, r.DeleteURLs(context.TODO(), []domain.DeleteURLItem{{UserID: userID, Short: short}}))
+
+	res, err := http.Post(ts.URL+constant.APIRoute+constant.ShortenRoute, "application/json", strings.NewReader(`{"url":"`+testURL+`"}`))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, res.Body.Close()) }()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var result domain.ResultURL
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	assert.NotEqual(t, localURL+short, result.Result)
+
+	got, err := s.GetFromShort(context.TODO(), strings.TrimPrefix(result.Result, localURL))
+	require.NoError(t, err)
+	assert.Equal(t, testURL, got)
+
+	// the deleted short is kept
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err = client.Get(ts.URL + "/" + short)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusGone, res.StatusCode)
+	res, err = http.Get(ts.URL + constant.APIRoute + constant.ShortenRoute + "/" + short + constant.StatsRoute)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestHandler_ReshortenExpired(t *testing.T) {
+	r := repository.NewRepository(repository.Config{DB: db})
+	s := service.NewService(r, conf, testLogger)
+	ts := httptest.NewServer(NewHandler(s, conf, testLogger).Handler())
+	defer ts.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	testURL := "https://practicum.yandex.ru/?expired" + shortcode.Default().Generate("", 0)
+	localURL := "http://" + baseURL + "/"
+
+	create := func() (int, string) {
+		res, err := client.Post(ts.URL+constant.APIRoute+constant.ShortenRoute, "application/json",
+			strings.NewReader(`{"url":"`+testURL+`","expires_in":1}`))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, res.Body.Close()) }()
+		var result domain.ResultURL
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return res.StatusCode, strings.TrimPrefix(result.Result, localURL)
+	}
+	get := func(short string) int {
+		res, err := client.Get(ts.URL + "/" + short)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	code, short := create()
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, http.StatusTemporaryRedirect, get(short))
+
+	require.Eventually(t, func() bool { return get(short) == http.StatusGone }, 3*time.Second, 100*time.Millisecond)
+
+	code, again := create()
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, short, again)
+	assert.Equal(t, http.StatusTemporaryRedirect, get(again))
+
+	// the expired short is kept
+	assert.Equal(t, http.StatusGone, get(short))
+	res, err := http.Get(ts.URL + constant.APIRoute + constant.ShortenRoute + "/" + short + constant.StatsRoute)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestHandler_RestoreCanonical(t *testing.T) {
+	c := *conf
+	c.DatabaseDSN = ""
+	c.FileStoragePath = t.TempDir() + "/storage.json"
+	// the file of version 0 is written before the urls were made canonical
+	require.NoError(t, os.WriteFile(c.FileStoragePath, []byte(
+		`{"uuid":"1","short_url":"canonical","original_url":"HTTPS://Canonical.Example:443/path"}`+"\n"), 0644))
+	r := repository.NewRepository(repository.Config{StorageFile: c.FileStoragePath})
+	s := service.NewService(r, &c, testLogger)
+	data, err := r.Restore()
+	require.NoError(t, err)
+	require.NoError(t, s.RestoreAll(data))
+
+	short, err := s.NewShort(context.TODO(), domain.CreateURL{URL: "https://canonical.example/path"})
+	assert.ErrorIs(t, err, myErr.ErrAlreadyExist)
+	assert.Equal(t, "http://"+baseURL+"/canonical", short)
+}
+
+func TestHandler_UserCookieSecure(t *testing.T) {
+	for _, https := range []bool{false, true} {
+		c := *conf
+		c.EnableHTTPS = https
+		r := repository.NewRepository(repository.Config{DB: db})
+		h := NewHandler(service.NewService(r, &c, testLogger), &c, testLogger).Handler()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, constant.APIRoute+constant.UserRoute+constant.URLsRoute, nil))
+		res := w.Result()
+		require.NoError(t, res.Body.Close())
+		var cookie *http.Cookie
+		for _, c := range res.Cookies() {
+			if c.Name == constant.CookieUserName {
+				cookie = c
+			}
+		}
+		require.NotNil(t, cookie)
+		assert.Equal(t, https, cookie.Secure)
+		assert.True(t, cookie.HttpOnly)
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Blocked link</title></head>
+<body>
+<h1>The link is blocked</h1>
+<p>The short link leads to the address that is considered unsafe:</p>
+<p><code>{{.URL}}</code></p>
+<p>Reason: {{.Reason}}</p>
+</body>
+</html>
+`))
+
+// GetWarning shows the page in place of the target of the blocked short link,
+// the link that is not blocked anymore is sent back to the redirect
+func (h *Handler) GetWarning() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c, h.c.OperationTimeoutDuration())
+		defer cancel()
+		newURL, err := h.s.GetFromShort(ctx, c.Param("id"))
+		switch {
+		case err == nil:
+			c.Redirect(http.StatusTemporaryRedirect, "/"+c.Param("id"))
+			return
+		case errors.Is(err, myErr.ErrNotExist):
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		case errors.Is(err, myErr.ErrIsDeleted) || errors.Is(err, myErr.ErrExpired):
+			c.AbortWithStatus(http.StatusGone)
+			return
+		case !errors.Is(err, myErr.ErrBlocked):
+			c.AbortWithStatus(http.StatusInternalServerError)
+			h.logger(c).WithField("Error", err).Error("Error get short for warning")
+			return
+		}
+		blocked, _ := blockedResult(err)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err = warningPage.Execute(c.Writer, struct{ URL, Reason string }{newURL, blocked.Reason}); err != nil {
+			h.logger(c).WithField("Error", err).Error("Error render warning")
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package helper
+
+import (
+	"context"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+)
+
+// UserIDFromContext returns the user id stored by the auth middleware,
+// empty string if the request is anonymous
+func UserIDFromContext(ctx context.Context) string {
+	if userID, ok := ctx.Value(constant.ContextUserValueName).(string); ok {
+		return userID
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("unknown key")
+
+// Keyring is the set of AES keys by their id. The first key is the active one, the data is sealed with it,
+// the rest are kept to open the data sealed before the rotation
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// Parse reads the keys as "id:base64 key", separated by commas or new lines.
+// Lines starting with # are comments. The key is 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+// No keys is nil keyring
+func Parse(s string) (*Keyring, error) {
+	var k *Keyring
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if entry = strings.TrimSpace(entry); entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if id = strings.TrimSpace(id); !ok || id == "" {
+			return nil, fmt.Errorf("key entry is not id:key")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if k == nil {
+			k = &Keyring{active: id, aeads: make(map[string]cipher.AEAD)}
+		}
+		if _, exist := k.aeads[id]; exist {
+			return nil, fmt.Errorf("key %q is duplicated", id)
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// ParseFile reads the keys of the file as Parse does
+func ParseFile(name string) (*Keyring, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	k, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return k, nil
+}
+
+// ActiveID is the id of the key sealing the data, empty for nil keyring
+func (k *Keyring) ActiveID() string {
+	if k == nil {
+		return ""
+	}
+	return k.active
+}
+
+// Seal encrypts with the active key, the data is the nonce followed by the ciphertext.
+// The key id is authenticated with the data
+func (k *Keyring) Seal(plain []byte) (id string, data []byte, err error) {
+	aead := k.aeads[k.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	return k.active, aead.Seal(nonce, nonce, plain, []byte(k.active)), nil
+}
+
+// Open decrypts the data sealed with the key id
+func (k *Keyring) Open(id string, data []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(id))
+}
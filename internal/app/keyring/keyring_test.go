@@ -0,0 +1,93 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func key(b byte, n int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, n))
+}
+
+func TestParse(t *testing.T) {
+	k, err := Parse("# rotated\nk2:" + key(2, 16) + ",\n k1 : " + key(1, 32) + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, "k2", k.ActiveID())
+
+	k, err = Parse("")
+	require.NoError(t, err)
+	assert.Nil(t, k)
+	assert.Equal(t, "", k.ActiveID())
+
+	for name, s := range map[string]string{
+		"no id":      ":" + key(1, 32),
+		"no key":     "k1",
+		"not base64": "k1:not base64!",
+		"key size":   "k1:" + key(1, 10),
+		"duplicated": "k1:" + key(1, 32) + ",k1:" + key(2, 32),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	fileName := t.TempDir() + "/keys"
+	require.NoError(t, os.WriteFile(fileName, []byte("k1:"+key(1, 32)+"\n"), 0600))
+	k, err := ParseFile(fileName)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", k.ActiveID())
+
+	require.NoError(t, os.WriteFile(fileName, []byte("k1"), 0600))
+	_, err = ParseFile(fileName)
+	assert.ErrorContains(t, err, fileName)
+}
+
+func TestKeyring_SealOpen(t *testing.T) {
+	k1, err := Parse("k1:" + key(1, 32))
+	require.NoError(t, err)
+	// the rotated keyring seals with k2 and still opens k1
+	k21, err := Parse("k2:" + key(2, 16) + ",k1:" + key(1, 32))
+	require.NoError(t, err)
+	k2, err := Parse("k2:" + key(2, 16))
+	require.NoError(t, err)
+	plain := []byte("https://encrypted.example/?token=secret-token")
+
+	id, data, err := k1.Seal(plain)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", id)
+	assert.False(t, bytes.Contains(data, plain))
+	_, data2, err := k1.Seal(plain)
+	require.NoError(t, err)
+	assert.NotEqual(t, data, data2, "the nonce is random")
+
+	opened, err := k21.Open(id, data)
+	require.NoError(t, err)
+	assert.Equal(t, plain, opened)
+
+	_, err = k2.Open(id, data)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	var nilKeyring *Keyring
+	_, err = nilKeyring.Open(id, data)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	// the key id is authenticated with the data
+	id, data, err = k21.Seal(plain)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", id)
+	_, err = k21.Open("k1", data)
+	assert.Error(t, err)
+
+	data[len(data)-1] ^= 1
+	_, err = k21.Open(id, data)
+	assert.Error(t, err)
+	_, err = k21.Open(id, data[:4])
+	assert.Error(t, err)
+}
@@ -1,14 +1,59 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
-func Logger() gin.HandlerFunc {
+// New makes the logger of the level writing in the format: text or json
+func New(level, format string) (*logrus.Logger, error) {
+	l := logrus.New()
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	l.SetLevel(lvl)
+	switch format {
+	case constant.LogFormatJSON:
+		l.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339})
+	case constant.LogFormatText, "":
+		l.SetFormatter(&logrus.TextFormatter{
+			TimestampFormat: "2006-01-02 15:04:05",
+			FullTimestamp:   true,
+		})
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return l, nil
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns the ctx carrying the id of the request served
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// FromContext adds the id of the request of ctx, if any, to the log lines
+func FromContext(ctx context.Context, l logrus.FieldLogger) logrus.FieldLogger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		return l.WithField("request_id", id)
+	}
+	return l
+}
+
+// WithRequestID adds the id of the request served to the log lines
+func WithRequestID(c *gin.Context, l logrus.FieldLogger) logrus.FieldLogger {
+	return FromContext(c.Request.Context(), l)
+}
+
+func Logger(l logrus.FieldLogger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 		defer func() {
@@ -16,7 +61,7 @@ func Logger() gin.HandlerFunc {
 			if c.Request.TLS != nil {
 				scheme = "https"
 			}
-			logrus.WithFields(logrus.Fields{
+			WithRequestID(c, l).WithFields(logrus.Fields{
 				"status":   c.Writer.Status(),
 				"method":   c.Request.Method,
 				"URI":      fmt.Sprintf("%s://%s%s %s", scheme, c.Request.Host, c.Request.RequestURI, c.Request.Proto),
@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes its samples in the prometheus text exposition format
+type Collector interface {
+	Write(w *bufio.Writer)
+}
+
+type Registry struct {
+	m          sync.RWMutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c ...Collector) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.collectors = append(r.collectors, c...)
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range r.collectors {
+		c.Write(bw)
+	}
+	return bw.Flush()
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer, typ string) {
+	w.WriteString("# HELP " + d.name + " " + d.help + "\n")
+	w.WriteString("# TYPE " + d.name + " " + typ + "\n")
+}
+
+// key joins label values to the map key, labels order is the one of desc
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (d desc) labelPairs(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, l := range d.labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, l+`="`+escape(v)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type counterValue struct {
+	values []string
+	v      float64
+}
+
+// CounterVec is a monotonic counter partitioned by labels
+type CounterVec struct {
+	desc
+	m      sync.Mutex
+	values map[string]*counterValue
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]*counterValue),
+	}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	k := key(labelValues)
+	c.m.Lock()
+	defer c.m.Unlock()
+	cv, ok := c.values[k]
+	if !ok {
+		cv = &counterValue{values: labelValues}
+		c.values[k] = cv
+	}
+	cv.v += v
+}
+
+func (c *CounterVec) Write(w *bufio.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.writeHeader(w, "counter")
+	for _, k := range sortedKeys(c.values) {
+		cv := c.values[k]
+		w.WriteString(c.name + c.labelPairs(cv.values) + " " + formatFloat(cv.v) + "\n")
+	}
+}
+
+type histogramValue struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec counts observations to cumulative buckets partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	m       sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// DefBuckets are the default latency buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := key(labelValues)
+	h.m.Lock()
+	defer h.m.Unlock()
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{values: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *HistogramVec) Write(w *bufio.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, k := range sortedKeys(h.values) {
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			w.WriteString(h.name + "_bucket" + h.labelPairs(hv.values, "le", formatFloat(b)) + " " + strconv.FormatUint(hv.counts[i], 10) + "\n")
+		}
+		w.WriteString(h.name + "_bucket" + h.labelPairs(hv.values, "le", "+Inf") + " " + strconv.FormatUint(hv.count, 10) + "\n")
+		w.WriteString(h.name + "_sum" + h.labelPairs(hv.values) + " " + formatFloat(hv.sum) + "\n")
+		w.WriteString(h.name + "_count" + h.labelPairs(hv.values) + " " + strconv.FormatUint(hv.count, 10) + "\n")
+	}
+}
+
+// GaugeFunc reads its value on every scrape
+type GaugeFunc struct {
+	desc
+	typ string
+	f   func() float64
+}
+
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help}, typ: "gauge", f: f}
+}
+
+// NewCounterFunc is a GaugeFunc for the value that only grows
+func NewCounterFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help}, typ: "counter", f: f}
+}
+
+func (g *GaugeFunc) Write(w *bufio.Writer) {
+	g.writeHeader(w, g.typ)
+	w.WriteString(g.name + " " + formatFloat(g.f()) + "\n")
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"database/sql"
+)
+
+// RegisterDBStats exposes the connection pool stats of db
+func RegisterDBStats(r *Registry, db interface{ Stats() sql.DBStats }) {
+	r.Register(
+		NewGaugeFunc("shortener_db_open_connections", "Number of established connections both in use and idle",
+			func() float64 { return float64(db.Stats().OpenConnections) }),
+		NewGaugeFunc("shortener_db_in_use_connections", "Number of connections currently in use",
+			func() float64 { return float64(db.Stats().InUse) }),
+		NewGaugeFunc("shortener_db_idle_connections", "Number of idle connections",
+			func() float64 { return float64(db.Stats().Idle) }),
+		NewGaugeFunc("shortener_db_max_open_connections", "Maximum number of open connections to the database",
+			func() float64 { return float64(db.Stats().MaxOpenConnections) }),
+		NewCounterFunc("shortener_db_wait_count_total", "Total number of connections waited for",
+			func() float64 { return float64(db.Stats().WaitCount) }),
+		NewCounterFunc("shortener_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection",
+			func() float64 { return db.Stats().WaitDuration.Seconds() }),
+		NewCounterFunc("shortener_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns",
+			func() float64 { return float64(db.Stats().MaxIdleClosed) }),
+		NewCounterFunc("shortener_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime",
+			func() float64 { return float64(db.Stats().MaxLifetimeClosed) }),
+	)
+}
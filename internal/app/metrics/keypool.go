@@ -0,0 +1,14 @@
+package metrics
+
+// RegisterKeyPool exposes the reserve of the short code pool and the keyspace left
+func RegisterKeyPool(r *Registry, pool interface {
+	Reserve() int
+	KeyspaceRemaining() float64
+}) {
+	r.Register(
+		NewGaugeFunc("shortener_key_pool_reserve", "Number of pre-generated short codes ready to hand out",
+			func() float64 { return float64(pool.Reserve()) }),
+		NewGaugeFunc("shortener_keyspace_remaining", "Number of short codes the generator can still make",
+			pool.KeyspaceRemaining),
+	)
+}
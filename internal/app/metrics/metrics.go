@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RedirectHit     = "hit"
+	RedirectMiss    = "miss"
+	RedirectGone    = "gone"
+	RedirectBlocked = "blocked"
+
+	unmatchedRoute = "unmatched"
+)
+
+var (
+	Default = NewRegistry()
+
+	HTTPRequests = NewCounterVec("shortener_http_requests_total",
+		"Count of served http requests", "route", "method", "status")
+	HTTPDuration = NewHistogramVec("shortener_http_request_duration_seconds",
+		"Duration of served http requests", DefBuckets, "route", "method", "status")
+	Redirects = NewCounterVec("shortener_redirects_total",
+		"Count of short url redirect lookups by result", "result")
+	ShortCollisions = NewCounterVec("shortener_short_collisions_total",
+		"Count of generated short codes that already existed and were retried", "storage")
+	FileSaveDuration = NewHistogramVec("shortener_file_save_duration_seconds",
+		"Duration of saving the storage file", DefBuckets)
+	StorageDamagedRecords = NewCounterVec("shortener_storage_damaged_records_total",
+		"Count of damaged storage file records skipped on restore")
+)
+
+func init() {
+	Default.Register(HTTPRequests, HTTPDuration, Redirects, ShortCollisions, FileSaveDuration, StorageDamagedRecords)
+}
+
+// Middleware counts requests and their duration per gin route, method and status
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		HTTPRequests.Inc(route, c.Request.Method, status)
+		HTTPDuration.Observe(time.Since(start).Seconds(), route, c.Request.Method, status)
+	}
+}
+
+// Handler serves the registry in the text exposition format
+func Handler(r *Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		_ = r.Write(c.Writer)
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var errBadUserCookie = errors.New("bad user cookie")
+
+// Auth identifies the user by the signed cookie. When the cookie is absent
+// or its signature does not match, a new user id is issued and the context
+// is marked with constant.ContextUserIsNewName. The secure cookie is sent over https only
+func Auth(secret string, secure bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := readUserCookie(c, secret)
+		if err != nil {
+			userID = uuid.New().String()
+			c.SetCookie(constant.CookieUserName, signUserID(userID, secret), constant.CookieUserMaxAge, "/", "", secure, true)
+			c.Set(constant.ContextUserIsNewName, true)
+		}
+		c.Set(constant.ContextUserValueName, userID)
+		c.Next()
+	}
+}
+
+func readUserCookie(c *gin.Context, secret string) (userID string, err error) {
+	var cookie string
+	if cookie, err = c.Cookie(constant.CookieUserName); err != nil {
+		return
+	}
+	id, sign, found := strings.Cut(cookie, ".")
+	if !found || id == "" {
+		err = errBadUserCookie
+		return
+	}
+	if !hmac.Equal([]byte(sign), []byte(hexSign(id, secret))) {
+		err = errBadUserCookie
+		return
+	}
+	userID = id
+	return
+}
+
+func signUserID(userID, secret string) string {
+	return userID + "." + hexSign(userID, secret)
+}
+
+func hexSign(s, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -2,8 +2,12 @@ package middleware
 
 import (
 	"compress/gzip"
+	"io"
+	"net/http"
 	"strings"
 
+	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
+
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -26,13 +30,17 @@ func Compress(level int, l logrus.FieldLogger) gin.HandlerFunc {
 		}
 		gz, err := gzip.NewWriterLevel(c.Writer, level)
 		if err != nil {
-			l.WithError(err).Error("gzip")
+			logger.WithRequestID(c, l).WithError(err).Error("gzip")
 			c.Next()
 			return
 		}
 		defer func() {
+			if c.Writer.Status() == http.StatusNoContent || c.Writer.Status() == http.StatusNotModified {
+				// response has no body, gzip footer must not be written
+				gz.Reset(io.Discard)
+			}
 			if err := gz.Close(); err != nil {
-				l.WithError(err).Error("gzip")
+				logger.WithRequestID(c, l).WithError(err).Error("gzip")
 			}
 		}()
 
@@ -51,7 +59,7 @@ func Decompress(l logrus.FieldLogger) gin.HandlerFunc {
 				err = gz.Close()
 			}
 			if err != nil {
-				l.WithError(err).Error("gzip")
+				logger.WithRequestID(c, l).WithError(err).Error("gzip")
 			}
 		}
 		c.Next()
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
+	"github.com/gin-gonic/gin"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a token bucket per client: rate tokens are added every second
+// up to burst, each request takes one. Buckets idle for RateLimitIdleTTL seconds
+// are dropped on the way of the next requests
+type Limiter struct {
+	rate    float64
+	burst   int
+	m       sync.Mutex
+	buckets map[string]*bucket
+	lastGC  time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		lastGC:  time.Now(),
+	}
+}
+
+// Allow takes a token of the key bucket. It returns the tokens left
+// and, when refused, how long to wait for the next one
+func (l *Limiter) Allow(key string) (ok bool, remaining int, retryAfter time.Duration) {
+	now := time.Now()
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.gc(now)
+
+	b, exist := l.buckets[key]
+	if !exist {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		retryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// gc drops the idle buckets, they are full anyway
+func (l *Limiter) gc(now time.Time) {
+	if now.Sub(l.lastGC) < constant.RateLimitIdleTTL*time.Second {
+		return
+	}
+	l.lastGC = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= constant.RateLimitIdleTTL*time.Second {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimit refuses with 429 the client that exceeds the limiter. The client is
+// one of apiKeys passed in RateLimitAPIKeyHeader, or the client ip otherwise.
+// Nil limiter is no limit
+func RateLimit(l *Limiter, apiKeys []string) gin.HandlerFunc {
+	if l == nil {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	keys := make(map[string]struct{}, len(apiKeys))
+	for _, k := range apiKeys {
+		keys[k] = struct{}{}
+	}
+	return func(c *gin.Context) {
+		key := "ip:" + c.ClientIP()
+		if apiKey := c.GetHeader(constant.RateLimitAPIKeyHeader); apiKey != "" {
+			if _, ok := keys[apiKey]; ok {
+				key = "key:" + apiKey
+			}
+		}
+		ok, remaining, retryAfter := l.Allow(key)
+		c.Header("X-RateLimit-Limit", strconv.Itoa(l.burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(l.burst)-float64(remaining))/l.rate))))
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestID takes the request id from the RequestIDHeader or issues a new one,
+// returns it in the response and keeps in the request context for the log lines
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(constant.RequestIDHeader)
+		if id == "" || len(id) > constant.RequestIDMaxLen {
+			id = uuid.New().String()
+		}
+		c.Request = c.Request.WithContext(logger.ContextWithRequestID(c.Request.Context(), id))
+		c.Header(constant.RequestIDHeader, id)
+		c.Next()
+	}
+}
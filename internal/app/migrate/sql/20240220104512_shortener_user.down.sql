@@ -0,0 +1,4 @@
+drop index shortener_user_id;
+
+alter table shortener
+ drop column user_id;
\ No newline at end of file
@@ -0,0 +1,5 @@
+alter table shortener
+ add user_id uuid;
+
+create index shortener_user_id
+ on shortener (user_id);
\ No newline at end of file
@@ -0,0 +1,2 @@
+alter table shortener
+ drop column is_deleted;
\ No newline at end of file
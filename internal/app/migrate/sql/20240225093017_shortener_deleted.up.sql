@@ -0,0 +1,2 @@
+alter table shortener
+ add is_deleted boolean default false not null;
\ No newline at end of file
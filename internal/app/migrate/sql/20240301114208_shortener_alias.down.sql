@@ -0,0 +1,2 @@
+alter table shortener
+ alter column short type varchar(8);
\ No newline at end of file
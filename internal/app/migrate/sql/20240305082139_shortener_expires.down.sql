@@ -0,0 +1,4 @@
+drop index shortener_expires_at;
+
+alter table shortener
+ drop column expires_at;
\ No newline at end of file
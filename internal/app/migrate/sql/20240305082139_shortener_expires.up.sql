@@ -0,0 +1,6 @@
+alter table shortener
+ add expires_at timestamptz;
+
+create index shortener_expires_at
+ on shortener (expires_at)
+ where expires_at is not null;
\ No newline at end of file
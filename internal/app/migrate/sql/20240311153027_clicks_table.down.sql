@@ -0,0 +1 @@
+drop table clicks
\ No newline at end of file
@@ -0,0 +1,14 @@
+create table clicks
+(
+ id         bigserial                 not null
+  constraint clicks_pk
+   primary key,
+ short      varchar(32)               not null,
+ created_at timestamptz default now() not null,
+ referrer   text,
+ user_agent text,
+ ip_hash    varchar(64)
+);
+
+create index clicks_short_created_at
+ on clicks (short, created_at);
\ No newline at end of file
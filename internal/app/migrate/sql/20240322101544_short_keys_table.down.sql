@@ -0,0 +1 @@
+drop table short_keys
\ No newline at end of file
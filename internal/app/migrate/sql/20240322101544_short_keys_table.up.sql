@@ -0,0 +1,7 @@
+create table short_keys
+(
+ short      varchar(32)               not null
+  constraint short_keys_pk
+   primary key,
+ created_at timestamptz default now() not null
+);
\ No newline at end of file
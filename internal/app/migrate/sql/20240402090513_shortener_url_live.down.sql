@@ -0,0 +1,13 @@
+drop index shortener_url;
+
+delete
+from shortener d
+ using shortener k
+where d.url = k.url
+  and d.uuid <> k.uuid
+  and d.is_deleted
+  and (not k.is_deleted or k.uuid > d.uuid);
+
+alter table shortener
+ add constraint shortener_url
+  unique (url);
\ No newline at end of file
@@ -0,0 +1,6 @@
+alter table shortener
+ drop constraint shortener_url;
+
+create unique index shortener_url
+ on shortener (url)
+ where not is_deleted;
\ No newline at end of file
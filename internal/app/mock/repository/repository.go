@@ -36,6 +36,48 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 	return m.recorder
 }
 
+// Close mocks base method.
+func (m *MockRepository) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockRepositoryMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockRepository)(nil).Close))
+}
+
+// Compact mocks base method.
+func (m *MockRepository) Compact(arg0 context.Context, arg1 func(context.Context) (repository.Store, error)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compact", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Compact indicates an expected call of Compact.
+func (mr *MockRepositoryMockRecorder) Compact(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compact", reflect.TypeOf((*MockRepository)(nil).Compact), arg0, arg1)
+}
+
+// DeleteURLs mocks base method.
+func (m *MockRepository) DeleteURLs(arg0 context.Context, arg1 []domain.DeleteURLItem) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteURLs", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteURLs indicates an expected call of DeleteURLs.
+func (mr *MockRepositoryMockRecorder) DeleteURLs(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteURLs", reflect.TypeOf((*MockRepository)(nil).DeleteURLs), arg0, arg1)
+}
+
 // GetAll mocks base method.
 func (m *MockRepository) GetAll(arg0 context.Context) (repository.Store, error) {
 	m.ctrl.T.Helper()
@@ -81,8 +123,38 @@ func (mr *MockRepositoryMockRecorder) GetFromURL(arg0, arg1 interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFromURL", reflect.TypeOf((*MockRepository)(nil).GetFromURL), arg0, arg1)
 }
 
+// GetStats mocks base method.
+func (m *MockRepository) GetStats(arg0 context.Context, arg1 string, arg2 domain.StatsQuery) (domain.Stats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStats", arg0, arg1, arg2)
+	ret0, _ := ret[0].(domain.Stats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetStats indicates an expected call of GetStats.
+func (mr *MockRepositoryMockRecorder) GetStats(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStats", reflect.TypeOf((*MockRepository)(nil).GetStats), arg0, arg1, arg2)
+}
+
+// GetUserURLs mocks base method.
+func (m *MockRepository) GetUserURLs(arg0 context.Context, arg1 string) ([]domain.UserURLItem, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserURLs", arg0, arg1)
+	ret0, _ := ret[0].([]domain.UserURLItem)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserURLs indicates an expected call of GetUserURLs.
+func (mr *MockRepositoryMockRecorder) GetUserURLs(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserURLs", reflect.TypeOf((*MockRepository)(nil).GetUserURLs), arg0, arg1)
+}
+
 // NewShort mocks base method.
-func (m *MockRepository) NewShort(arg0 context.Context, arg1 string) (string, error) {
+func (m *MockRepository) NewShort(arg0 context.Context, arg1 domain.CreateURL) (string, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "NewShort", arg0, arg1)
 	ret0, _ := ret[0].(string)
@@ -111,6 +183,21 @@ func (mr *MockRepositoryMockRecorder) NewShortBatch(arg0, arg1, arg2 interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewShortBatch", reflect.TypeOf((*MockRepository)(nil).NewShortBatch), arg0, arg1, arg2)
 }
 
+// NewShortBatchPartial mocks base method.
+func (m *MockRepository) NewShortBatchPartial(arg0 context.Context, arg1 []domain.ShortBatchInputItem, arg2 string) ([]domain.ShortBatchResultItem, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewShortBatchPartial", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]domain.ShortBatchResultItem)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NewShortBatchPartial indicates an expected call of NewShortBatchPartial.
+func (mr *MockRepositoryMockRecorder) NewShortBatchPartial(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewShortBatchPartial", reflect.TypeOf((*MockRepository)(nil).NewShortBatchPartial), arg0, arg1, arg2)
+}
+
 // Ping mocks base method.
 func (m *MockRepository) Ping(arg0 context.Context) error {
 	m.ctrl.T.Helper()
@@ -125,6 +212,21 @@ func (mr *MockRepositoryMockRecorder) Ping(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockRepository)(nil).Ping), arg0)
 }
 
+// PurgeExpired mocks base method.
+func (m *MockRepository) PurgeExpired(arg0 context.Context) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeExpired", arg0)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeExpired indicates an expected call of PurgeExpired.
+func (mr *MockRepositoryMockRecorder) PurgeExpired(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeExpired", reflect.TypeOf((*MockRepository)(nil).PurgeExpired), arg0)
+}
+
 // Restore mocks base method.
 func (m *MockRepository) Restore() (repository.Store, error) {
 	m.ctrl.T.Helper()
@@ -167,3 +269,31 @@ func (mr *MockRepositoryMockRecorder) Save(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockRepository)(nil).Save), arg0)
 }
+
+// SaveClicks mocks base method.
+func (m *MockRepository) SaveClicks(arg0 context.Context, arg1 []domain.Click) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveClicks", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveClicks indicates an expected call of SaveClicks.
+func (mr *MockRepositoryMockRecorder) SaveClicks(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveClicks", reflect.TypeOf((*MockRepository)(nil).SaveClicks), arg0, arg1)
+}
+
+// Writable mocks base method.
+func (m *MockRepository) Writable() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Writable")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Writable indicates an expected call of Writable.
+func (mr *MockRepositoryMockRecorder) Writable() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Writable", reflect.TypeOf((*MockRepository)(nil).Writable))
+}
@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+type ClickStorage interface {
+	SaveClicks(ctx context.Context, clicks []domain.Click) error
+}
+
+// MemClickStorage keeps the last maxCount clicks in the ring, the oldest ones are overwritten
+type MemClickStorage struct {
+	clicks   []domain.Click
+	next     int
+	maxCount int
+	m        sync.RWMutex
+}
+
+func NewMemClickStorage(maxCount int) *MemClickStorage {
+	return &MemClickStorage{maxCount: maxCount}
+}
+
+func (s *MemClickStorage) SaveClicks(ctx context.Context, clicks []domain.Click) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, c := range clicks {
+		if len(s.clicks) < s.maxCount {
+			s.clicks = append(s.clicks, c)
+			continue
+		}
+		s.clicks[s.next] = c
+		s.next = (s.next + 1) % s.maxCount
+	}
+	return nil
+}
+
+// FileClickStorage appends clicks as json lines to the file. The clicks of the file are read once
+// and kept by short, so the stats do not read the file again
+type FileClickStorage struct {
+	fileName string
+	clicks   map[string][]domain.Click
+	log      logrus.FieldLogger
+	m        sync.RWMutex
+}
+
+func NewFileClickStorage(f string, log logrus.FieldLogger) *FileClickStorage {
+	return &FileClickStorage{
+		fileName: f,
+		log:      log,
+	}
+}
+
+// load reads the clicks of the file, if not read yet. The damaged lines are skipped,
+// the torn last line of the append cut in the middle is cut off, so the next append starts the new line.
+// It is called with the lock held
+func (s *FileClickStorage) load() (err error) {
+	if s.clicks != nil {
+		return
+	}
+	var lines []walRawLine
+	if lines, err = readWALLines(s.fileName); err != nil {
+		return
+	}
+	clicks := make(map[string][]domain.Click)
+	for n, line := range lines {
+		var c domain.Click
+		if errD := json.Unmarshal(line.raw, &c); errD != nil {
+			if n == len(lines)-1 && !line.terminated {
+				s.log.WithError(errD).WithFields(logrus.Fields{"file": s.fileName, "offset": line.offset}).
+					Warn("Click file is broken, the tail is cut off")
+				if err = os.Truncate(s.fileName, line.offset); err != nil {
+					return
+				}
+				break
+			}
+			s.log.WithError(errD).WithFields(logrus.Fields{"file": s.fileName, "line": line.no}).
+				Warn("Damaged click is skipped")
+			continue
+		}
+		clicks[c.Short] = append(clicks[c.Short], c)
+	}
+	s.clicks = clicks
+	return
+}
+
+func (s *FileClickStorage) SaveClicks(ctx context.Context, clicks []domain.Click) (err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err = s.load(); err != nil {
+		return
+	}
+	var file *os.File
+	if file, err = os.OpenFile(s.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	defer func() {
+		if errC := file.Close(); err == nil {
+			err = errC
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	for i := range clicks {
+		if err = encoder.Encode(&clicks[i]); err != nil {
+			return
+		}
+		s.clicks[clicks[i].Short] = append(s.clicks[clicks[i].Short], clicks[i])
+	}
+	return
+}
+
+type DBClickStorage struct {
+	db *sqlx.DB
+}
+
+func NewDBClickStorage(db *sqlx.DB) *DBClickStorage {
+	return &DBClickStorage{
+		db: db,
+	}
+}
+
+func (s *DBClickStorage) SaveClicks(ctx context.Context, clicks []domain.Click) (err error) {
+	var (
+		shorts     = make([]string, 0, len(clicks))
+		times      = make([]time.Time, 0, len(clicks))
+		referrers  = make([]string, 0, len(clicks))
+		userAgents = make([]string, 0, len(clicks))
+		ipHashes   = make([]string, 0, len(clicks))
+	)
+	for _, c := range clicks {
+		shorts = append(shorts, c.Short)
+		times = append(times, c.Time)
+		referrers = append(referrers, c.Referrer)
+		userAgents = append(userAgents, c.UserAgent)
+		ipHashes = append(ipHashes, c.IPHash)
+	}
+	sqlStr := `INSERT INTO ` + constant.DBClicksTableName + ` (short, created_at, referrer, user_agent, ip_hash)
+ SELECT * FROM unnest($1::varchar[], $2::timestamptz[], $3::text[], $4::text[], $5::varchar[])`
+	_, err = s.db.ExecContext(ctx, sqlStr, shorts, times, referrers, userAgents, ipHashes)
+	return
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemClickStorage(t *testing.T) {
+	s := NewMemClickStorage(3)
+	start := time.Now().UTC().Truncate(time.Hour)
+	click := func(i int) domain.Click {
+		return domain.Click{Time: start.Add(time.Duration(i) * time.Minute), Short: "short", IPHash: string(rune('a' + i))}
+	}
+	require.NoError(t, s.SaveClicks(context.TODO(), []domain.Click{click(0), click(1)}))
+	require.NoError(t, s.SaveClicks(context.TODO(), []domain.Click{click(2), click(3), click(4)}))
+
+	// the storage keeps the last clicks only
+	assert.Len(t, s.clicks, 3)
+	stats, err := s.GetStats(context.TODO(), "short", domain.StatsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Total)
+	stats, err = s.GetStats(context.TODO(), "short", domain.StatsQuery{From: click(2).Time})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Total)
+	stats, err = s.GetStats(context.TODO(), "short", domain.StatsQuery{To: click(2).Time})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Total)
+}
+
+func TestFileClickStorage(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Hour)
+	click := func(short string, i int) domain.Click {
+		return domain.Click{Time: start.Add(time.Duration(i) * time.Minute), Short: short}
+	}
+	line := func(c domain.Click) string {
+		b, err := json.Marshal(c)
+		require.NoError(t, err)
+		return string(b) + "\n"
+	}
+	fileName := t.TempDir() + "/storage.json.clicks"
+	// the damaged line in the middle and the append cut in the middle
+	require.NoError(t, os.WriteFile(fileName, []byte(line(click("a", 0))+`{"short":`+"\n"+line(click("b", 1))+
+		line(click("a", 2))[:20]), 0644))
+
+	s := NewFileClickStorage(fileName, testLog())
+	stats, err := s.GetStats(context.TODO(), "a", domain.StatsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+
+	require.NoError(t, s.SaveClicks(context.TODO(), []domain.Click{click("a", 3)}))
+	stats, err = s.GetStats(context.TODO(), "a", domain.StatsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Total)
+
+	// the torn tail is cut off, so the saved click is read again
+	s = NewFileClickStorage(fileName, testLog())
+	stats, err = s.GetStats(context.TODO(), "a", domain.StatsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Total)
+	stats, err = s.GetStats(context.TODO(), "b", domain.StatsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+}
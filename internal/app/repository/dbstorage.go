@@ -5,31 +5,55 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
+
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
 	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/helper"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
 )
 
 type DBStorageItem struct {
-	UUID  string `db:"uuid"`
-	Short string `db:"short"`
-	URL   string `db:"url"`
+	UUID      string         `db:"uuid"`
+	Short     string         `db:"short"`
+	URL       string         `db:"url"`
+	UserID    sql.NullString `db:"user_id"`
+	IsDeleted bool           `db:"is_deleted"`
+	ExpiresAt sql.NullTime   `db:"expires_at"`
 }
 
 type DBStorageRepo struct {
-	db *sqlx.DB
+	db   *sqlx.DB
+	gen  shortcode.CodeGenerator
+	pool *KeyPool
+	log  logrus.FieldLogger
 }
 
-func NewDBStorageRepository(db *sqlx.DB) *DBStorageRepo {
+func NewDBStorageRepository(db *sqlx.DB, gen shortcode.CodeGenerator, log logrus.FieldLogger) *DBStorageRepo {
 	return &DBStorageRepo{
-		db: db,
+		db:  db,
+		gen: gen,
+		log: log,
+	}
+}
+
+// nextShort is the code of the pool, if any, or the generated one, not the reserved one
+func (r *DBStorageRepo) nextShort(url string, attempt int) string {
+	if r.pool != nil {
+		if k, ok := r.pool.Take(); ok {
+			return k.String()
+		}
 	}
+	return shortcode.Generate(r.gen, url, attempt)
 }
 
 func (r *DBStorageRepo) Ping(ctx context.Context) error {
@@ -40,36 +64,87 @@ func (r *DBStorageRepo) Ping(ctx context.Context) error {
 }
 
 func (r *DBStorageRepo) saveNew(item DBStorageItem) (err error) {
-	_, err = r.db.Exec("insert into "+constant.DBTableName+" (short, url) values ($1, $2)",
-		item.Short, item.URL)
+	_, err = r.db.Exec("insert into "+constant.DBTableName+" (short, url, user_id, is_deleted, expires_at) values ($1, $2, $3, $4, $5)",
+		item.Short, item.URL, item.UserID, item.IsDeleted, item.ExpiresAt)
 	return
 }
 
-func (r *DBStorageRepo) NewShort(ctx context.Context, url string) (short string, err error) {
+// insertNew inserts the item unless its url is stored, then the stored short is returned with myErr.ErrAlreadyExist.
+// The deleted and expired rows of the url are kept, the url is unique among the not deleted ones.
+// The insert of the url waits for the concurrent one to commit, so the url is stored once
+func (r *DBStorageRepo) insertNew(ctx context.Context, item DBStorageItem) (short string, err error) {
 	for {
+		if err = r.releaseExpired(ctx, r.db, []string{item.URL}); err != nil {
+			return
+		}
+		if err = r.db.GetContext(ctx, &short, "insert into "+constant.DBTableName+" (short, url, user_id, expires_at) values ($1, $2, $3, $4)"+
+			" on conflict (url) where not is_deleted do nothing returning short",
+			item.Short, item.URL, item.UserID, item.ExpiresAt); !errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		if err = r.db.GetContext(ctx, &short, "select short from "+constant.DBTableName+" where url = $1 and not is_deleted and (expires_at is null or expires_at > now())", item.URL); err == nil {
+			err = myErr.ErrAlreadyExist
+			return
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		// the conflicting url is purged, deleted or expired in between, so it is inserted again
+	}
+}
+
+// releaseExpired marks the expired rows of the urls deleted, so the urls are free for the insert.
+// The expired row keeps its short and clicks, its short is still answered as expired
+func (r *DBStorageRepo) releaseExpired(ctx context.Context, db sqlx.ExecerContext, urls []string) (err error) {
+	_, err = db.ExecContext(ctx, "update "+constant.DBTableName+" set is_deleted = true"+
+		" where url = any($1::varchar[]) and not is_deleted and expires_at <= now()", urls)
+	return
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (r *DBStorageRepo) NewShort(ctx context.Context, in domain.CreateURL) (short string, err error) {
+	var (
+		userID    = nullString(helper.UserIDFromContext(ctx))
+		expiresAt = nullTime(timeOrZero(in.ExpiresAt))
+	)
+	if in.Alias != "" {
+		short, err = r.insertNew(ctx, DBStorageItem{Short: in.Alias, URL: in.URL, UserID: userID, ExpiresAt: expiresAt})
+		var errP *pgconn.PgError
+		if errors.As(err, &errP) && errP.Code == pgerrcode.UniqueViolation && errP.ConstraintName == constant.DBShortConstraintName {
+			err = myErr.ErrAliasTaken
+		}
+		return
+	}
+	for attempt := 0; ; attempt++ {
 		select {
 		case <-ctx.Done():
 			err = ctx.Err()
 			return
 		default:
-			newShort := helper.NewRandShorter().RandStringBytes().String()
-			if errS := r.saveNew(DBStorageItem{Short: newShort, URL: url}); errS == nil {
-				short = newShort
-				return
-			} else if errP, ok := errS.(*pgconn.PgError); !ok || errP.Code != pgerrcode.UniqueViolation {
-				err = errS
+			newShort := r.nextShort(in.URL, attempt)
+			var errP *pgconn.PgError
+			if short, err = r.insertNew(ctx, DBStorageItem{Short: newShort, URL: in.URL, UserID: userID, ExpiresAt: expiresAt}); !errors.As(err, &errP) || errP.Code != pgerrcode.UniqueViolation {
 				return
 			}
+			short, err = "", nil
+			metrics.ShortCollisions.Inc("db")
+			logger.FromContext(ctx, r.log).WithField("short", newShort).Debug("Short collision, retry")
 		}
 	}
 }
 
 func (r *DBStorageRepo) GetFromShort(ctx context.Context, k string) (v string, err error) {
-	if len([]byte(k)) != len(config.ShortKey{}) {
+	if len(k) > constant.AliasMaxLen {
 		err = myErr.ErrNotExist
 		return
 	}
-	sqlStr := `SELECT uuid, short, url FROM ` + constant.DBTableName + ` WHERE short = $1`
+	sqlStr := `SELECT uuid, short, url, user_id, is_deleted, expires_at FROM ` + constant.DBTableName + ` WHERE short = $1`
 	var item = DBStorageItem{}
 	if err = r.db.GetContext(ctx, &item, sqlStr, k); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -77,13 +152,23 @@ func (r *DBStorageRepo) GetFromShort(ctx context.Context, k string) (v string, e
 		}
 		return
 	}
+	// the expired row is marked deleted when its url is shortened again, so the expiry is checked first
+	if item.ExpiresAt.Valid && !item.ExpiresAt.Time.After(time.Now()) {
+		err = myErr.ErrExpired
+		return
+	}
+	if item.IsDeleted {
+		err = myErr.ErrIsDeleted
+		return
+	}
 	v = item.URL
 	return
 }
 
 func (r *DBStorageRepo) GetFromURL(ctx context.Context, url string) (v string, err error) {
 	var item = DBStorageItem{}
-	sqlStr := `SELECT uuid, short, url FROM ` + constant.DBTableName + ` WHERE url = $1`
+	sqlStr := `SELECT uuid, short, url, user_id, is_deleted, expires_at FROM ` + constant.DBTableName + ` WHERE url = $1 AND NOT is_deleted
+ AND (expires_at IS NULL OR expires_at > now())`
 	if err = r.db.GetContext(ctx, &item, sqlStr, url); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			err = nil
@@ -96,7 +181,7 @@ func (r *DBStorageRepo) GetFromURL(ctx context.Context, url string) (v string, e
 
 func (r *DBStorageRepo) GetAll(ctx context.Context) (data Store, err error) {
 	data = make(Store)
-	sqlStr := `SELECT uuid, short, url FROM ` + constant.DBTableName
+	sqlStr := `SELECT uuid, short, url, user_id, is_deleted, expires_at FROM ` + constant.DBTableName
 	var rows *sql.Rows
 	if rows, err = r.db.QueryContext(ctx, sqlStr); err != nil {
 		return
@@ -104,12 +189,15 @@ func (r *DBStorageRepo) GetAll(ctx context.Context) (data Store, err error) {
 	defer func() { err = rows.Close() }()
 	for rows.Next() {
 		var item = DBStorageItem{}
-		if err = rows.Scan(&item.UUID, &item.Short, &item.URL); err != nil {
+		if err = rows.Scan(&item.UUID, &item.Short, &item.URL, &item.UserID, &item.IsDeleted, &item.ExpiresAt); err != nil {
 			return
 		}
-		data[config.ShortKey([]byte(item.Short))] = storeItem{
-			uuid: item.UUID,
-			url:  item.URL,
+		data[config.ShortKey(item.Short)] = storeItem{
+			uuid:      item.UUID,
+			url:       item.URL,
+			userID:    item.UserID.String,
+			isDeleted: item.IsDeleted,
+			expiresAt: item.ExpiresAt.Time,
 		}
 	}
 	err = rows.Err()
@@ -118,18 +206,41 @@ func (r *DBStorageRepo) GetAll(ctx context.Context) (data Store, err error) {
 
 func (r *DBStorageRepo) RestoreAll(data Store) (err error) {
 	for short, item := range data {
-		if err = r.saveNew(DBStorageItem{Short: short.String(), URL: item.url, UUID: item.uuid}); err != nil {
+		if err = r.saveNew(DBStorageItem{Short: short.String(), URL: item.url, UUID: item.uuid, UserID: nullString(item.userID), IsDeleted: item.isDeleted, ExpiresAt: nullTime(item.expiresAt)}); err != nil {
 			return err
 		}
 	}
 	return
 }
 
-func (r *DBStorageRepo) NewShortBatch(ctx context.Context, input []domain.ShortBatchInputItem, prefix string) (out []domain.ShortBatchResultItem, err error) {
+// dbShortURL is the short of the url
+type dbShortURL struct {
+	Short string `db:"short"`
+	URL   string `db:"url"`
+}
+
+// NewShortBatch stores the new urls of the input with the one insert, the urls stored before get their shorts.
+// The items are retried only for the shorts taken meanwhile, the result is in the input order
+func (r *DBStorageRepo) NewShortBatch(ctx context.Context, input []domain.ShortBatchInputItem, prefix string) ([]domain.ShortBatchResultItem, error) {
+	return r.newShortBatch(ctx, input, prefix, false)
+}
+
+func (r *DBStorageRepo) NewShortBatchPartial(ctx context.Context, input []domain.ShortBatchInputItem, prefix string) ([]domain.ShortBatchResultItem, error) {
+	return r.newShortBatch(ctx, input, prefix, true)
+}
+
+// newShortBatch fails the whole batch on the taken alias, unless partial
+func (r *DBStorageRepo) newShortBatch(ctx context.Context, input []domain.ShortBatchInputItem, prefix string, partial bool) (out []domain.ShortBatchResultItem, err error) {
 	var (
-		tx *sqlx.Tx
+		tx      *sqlx.Tx
+		userID  = nullString(helper.UserIDFromContext(ctx))
+		shorts  = make(map[string]string, len(input))
+		pending = make([]domain.ShortBatchInputItem, 0, len(input))
+		seen    = make(map[string]bool, len(input))
+		created = make(map[string]bool, len(input))
+		taken   = make(map[string]bool)
 	)
-	tx, err = r.db.Beginx()
+	tx, err = r.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -141,35 +252,149 @@ func (r *DBStorageRepo) NewShortBatch(ctx context.Context, input []domain.ShortB
 		}
 	}()
 
+	// the repeated url gets the short of its first item
 	for _, i := range input {
-		for {
-			var newShort string
-			if err = tx.GetContext(ctx, &newShort, "select short from "+constant.DBTableName+" where url = $1", i.OriginalURL); err == nil {
-				out = append(out, domain.ShortBatchResultItem{
-					CorrelationTD: i.CorrelationID,
-					ShortURL:      prefix + newShort,
-				})
-				break
-			}
-			newShort = helper.NewRandShorter().RandStringBytes().String()
-			var exist int
-			if err = tx.GetContext(ctx, &exist, "select count(short) from "+constant.DBTableName+" where short = $1", newShort); err != nil {
-				return
-			}
-			if exist > 0 {
+		if !seen[i.OriginalURL] {
+			seen[i.OriginalURL] = true
+			pending = append(pending, i)
+		}
+	}
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if err = r.storedShorts(ctx, tx, pending, shorts); err != nil {
+			return
+		}
+		var (
+			next      []domain.ShortBatchInputItem
+			newShorts []string
+			urls      []string
+			expires   []*time.Time
+		)
+		for _, i := range pending {
+			if _, ok := shorts[i.OriginalURL]; ok {
 				continue
 			}
-			if _, err = tx.ExecContext(ctx, "INSERT INTO "+constant.DBTableName+" (short, url) VALUES($1, $2)", newShort, i.OriginalURL); err == nil {
-				out = append(out, domain.ShortBatchResultItem{
-					CorrelationTD: i.CorrelationID,
-					ShortURL:      prefix + newShort,
-				})
-				break
-			} else {
-				return
+			newShort := i.Alias
+			if attempt > 0 {
+				if i.Alias != "" && partial {
+					taken[i.OriginalURL] = true
+					continue
+				} else if i.Alias != "" {
+					err = &myErr.BatchItemError{CorrelationID: i.CorrelationID, Err: myErr.ErrAliasTaken}
+					return
+				}
+				metrics.ShortCollisions.Inc("db")
+			}
+			if newShort == "" {
+				newShort = r.nextShort(i.OriginalURL, attempt)
 			}
+			next = append(next, i)
+			newShorts = append(newShorts, newShort)
+			urls = append(urls, i.OriginalURL)
+			expires = append(expires, i.ExpiresAt)
+		}
+		if len(next) == 0 {
+			break
+		}
+		// the taken short or url is skipped by the insert and checked again by the next attempt
+		var inserted []dbShortURL
+		if err = tx.SelectContext(ctx, &inserted, "INSERT INTO "+constant.DBTableName+" (short, url, user_id, expires_at)"+
+			" SELECT s, u, $3::uuid, e FROM unnest($1::varchar[], $2::varchar[], $4::timestamptz[]) AS t(s, u, e)"+
+			" ON CONFLICT DO NOTHING RETURNING short, url",
+			newShorts, urls, userID, expires); err != nil {
+			return
+		}
+		for _, i := range inserted {
+			shorts[i.URL] = i.Short
+			created[i.URL] = true
+		}
+		pending = next
+		if len(inserted) < len(next) {
+			logger.FromContext(ctx, r.log).WithField("count", len(next)-len(inserted)).Debug("Batch shorts are taken, retry")
 		}
 	}
-	err = errors.Join(err, tx.Commit())
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	out = make([]domain.ShortBatchResultItem, len(input))
+	for n, i := range input {
+		out[n] = domain.ShortBatchResultItem{CorrelationTD: i.CorrelationID}
+		if taken[i.OriginalURL] {
+			out[n].Err = myErr.ErrAliasTaken
+			continue
+		}
+		out[n].ShortURL = prefix + shorts[i.OriginalURL]
+		// the repeated url is created by its first item
+		if partial && !created[i.OriginalURL] {
+			out[n].Err = myErr.ErrAlreadyExist
+		}
+		delete(created, i.OriginalURL)
+	}
+	return
+}
+
+// storedShorts adds the shorts of the stored urls of the items to shorts.
+// The expired rows of the urls are released for the insert
+func (r *DBStorageRepo) storedShorts(ctx context.Context, tx *sqlx.Tx, items []domain.ShortBatchInputItem, shorts map[string]string) (err error) {
+	urls := make([]string, 0, len(items))
+	for _, i := range items {
+		if _, ok := shorts[i.OriginalURL]; !ok {
+			urls = append(urls, i.OriginalURL)
+		}
+	}
+	if err = r.releaseExpired(ctx, tx, urls); err != nil {
+		return
+	}
+	var stored []dbShortURL
+	if err = tx.SelectContext(ctx, &stored, "SELECT short, url FROM "+constant.DBTableName+" WHERE url = ANY($1::varchar[]) AND NOT is_deleted"+
+		" AND (expires_at IS NULL OR expires_at > now())", urls); err != nil {
+		return
+	}
+	for _, i := range stored {
+		shorts[i.URL] = i.Short
+	}
+	return
+}
+
+func (r *DBStorageRepo) GetUserURLs(ctx context.Context, prefix string) (out []domain.UserURLItem, err error) {
+	userID := helper.UserIDFromContext(ctx)
+	if userID == "" {
+		return
+	}
+	sqlStr := `SELECT short, url FROM ` + constant.DBTableName + ` WHERE user_id = $1 AND NOT is_deleted
+ AND (expires_at IS NULL OR expires_at > now())`
+	var items []DBStorageItem
+	if err = r.db.SelectContext(ctx, &items, sqlStr, userID); err != nil {
+		return
+	}
+	for _, item := range items {
+		out = append(out, domain.UserURLItem{
+			ShortURL:    prefix + item.Short,
+			OriginalURL: item.URL,
+		})
+	}
 	return
 }
+
+func (r *DBStorageRepo) DeleteURLs(ctx context.Context, items []domain.DeleteURLItem) (err error) {
+	var (
+		shorts  = make([]string, 0, len(items))
+		userIDs = make([]string, 0, len(items))
+	)
+	for _, i := range items {
+		shorts = append(shorts, i.Short)
+		userIDs = append(userIDs, i.UserID)
+	}
+	sqlStr := `UPDATE ` + constant.DBTableName + ` s SET is_deleted = true
+ FROM unnest($1::varchar[], $2::uuid[]) AS d(short, user_id)
+ WHERE s.short = d.short AND s.user_id = d.user_id AND NOT s.is_deleted`
+	_, err = r.db.ExecContext(ctx, sqlStr, shorts, userIDs)
+	return
+}
+
+func (r *DBStorageRepo) PurgeExpired(ctx context.Context) (n int64, err error) {
+	var res sql.Result
+	if res, err = r.db.ExecContext(ctx, `DELETE FROM `+constant.DBTableName+` WHERE expires_at <= now()`); err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
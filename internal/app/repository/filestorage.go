@@ -1,36 +1,78 @@
 package repository
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
+
+	"github.com/sirupsen/logrus"
 )
 
 type FileStorage interface {
 	Save(data Store) error
 	Restore() (Store, error)
+	Writable() error
+	Compact(ctx context.Context, snapshot func(ctx context.Context) (Store, error)) error
+	Close() error
 }
 
 type FileStorageItem struct {
-	UUID        string `json:"uuid"`
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	UUID        string     `json:"uuid"`
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	UserID      string     `json:"user_id,omitempty"`
+	IsDeleted   bool       `json:"is_deleted,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
+func newFileStorageItem(short config.ShortKey, item storeItem) FileStorageItem {
+	fItem := FileStorageItem{
+		UUID:        item.uuid,
+		ShortURL:    short.String(),
+		OriginalURL: item.url,
+		UserID:      item.userID,
+		IsDeleted:   item.isDeleted,
+	}
+	if !item.expiresAt.IsZero() {
+		expiresAt := item.expiresAt
+		fItem.ExpiresAt = &expiresAt
+	}
+	return fItem
+}
+
+// FileStorageRepository keeps the storage snapshot in the file. With the wal set,
+// the changes since the snapshot are in the log, replayed by Restore and merged by Compact.
+// With recover set, Restore skips the damaged records of the file.
+// With keys set, the records of the file and the log are encrypted
 type FileStorageRepository struct {
 	Items    []FileStorageItem
 	fileName string
+	wal      *WAL
+	keys     *keyring.Keyring
+	recover  bool
 	m        sync.RWMutex
+	cm       sync.Mutex
+	log      logrus.FieldLogger
 }
 
-func NewFileStorage(f string) *FileStorageRepository {
+func NewFileStorage(f string, log logrus.FieldLogger) *FileStorageRepository {
 	return &FileStorageRepository{
 		fileName: f,
+		log:      log,
 	}
 }
 
@@ -40,25 +82,78 @@ func (f *FileStorageRepository) Save(data Store) error {
 	}
 	f.m.Lock()
 	defer f.m.Unlock()
+	defer func(start time.Time) {
+		metrics.FileSaveDuration.Observe(time.Since(start).Seconds())
+		f.log.WithFields(logrus.Fields{"file": f.fileName, "count": len(data), "duration": time.Since(start)}).Debug("Storage file saved")
+	}(time.Now())
 
-	s, err := NewSaver(f.fileName)
+	// the file is replaced at once, so the crash while saving keeps the previous one
+	tmpName := f.fileName + ".tmp"
+	s, err := NewSaver(tmpName, f.keys)
 	if err != nil {
 		return err
 	}
 	for short, item := range data {
-		fItem := FileStorageItem{
-			UUID:        item.uuid,
-			ShortURL:    short.String(),
-			OriginalURL: item.url,
-		}
+		fItem := newFileStorageItem(short, item)
 		if err = s.WriteData(&fItem); err != nil {
-			return err
+			return errors.Join(err, s.Close())
 		}
 	}
+	if err = s.file.Sync(); err != nil {
+		return errors.Join(err, s.Close())
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, f.fileName)
+}
 
-	return s.Close()
+// Compact saves the snapshot and drops the log records it includes.
+// The log is rotated before the snapshot is taken, so the records appended meanwhile are kept
+func (f *FileStorageRepository) Compact(ctx context.Context, snapshot func(ctx context.Context) (Store, error)) (err error) {
+	f.cm.Lock()
+	defer f.cm.Unlock()
+	if f.wal != nil {
+		if err = f.wal.rotate(); err != nil {
+			return
+		}
+	}
+	var data Store
+	if data, err = snapshot(ctx); err != nil {
+		return
+	}
+	if err = f.Save(data); err != nil {
+		return
+	}
+	if f.wal != nil {
+		err = f.wal.removeRotated()
+	}
+	return
+}
+
+// Close closes the log, if any
+func (f *FileStorageRepository) Close() error {
+	if f.wal == nil {
+		return nil
+	}
+	return f.wal.Close()
+}
+
+// Writable checks the storage file can be opened for writing, it is not changed
+func (f *FileStorageRepository) Writable() error {
+	if f.fileName == "" {
+		return fmt.Errorf("no storage file provided")
+	}
+	file, err := os.OpenFile(f.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
 }
 
+// Restore reads the storage file and replays the log over it. The damaged record fails
+// the restore, or with the recovery set, it is skipped and written to the quarantine file.
+// The broken last line of the log is the torn write, it is cut off
 func (f *FileStorageRepository) Restore() (data Store, err error) {
 	if f.fileName == "" {
 		err = fmt.Errorf("no storage file provided")
@@ -69,46 +164,136 @@ func (f *FileStorageRepository) Restore() (data Store, err error) {
 
 	data = make(Store)
 	var r *Reader
-	if r, err = NewReader(f.fileName); err != nil {
+	if r, err = NewReader(f.fileName, f.keys); err != nil {
 		return
 	}
+	if r.Version() < constant.StorageVersion {
+		f.log.WithFields(logrus.Fields{"file": f.fileName, "version": r.Version()}).
+			Info("Storage file of the old version, it is upgraded on the next save")
+	}
 
-	for err == nil {
+	q := &quarantine{fileName: f.fileName + constant.StorageQuarantineSuffix}
+	defer func() {
+		if errQ := q.close(); errQ != nil {
+			err = errors.Join(err, errQ)
+		}
+	}()
+	var damaged int
+	for {
 		var item *FileStorageItem
 		if item, err = r.ReadData(); err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return
+			var recErr *RecordError
+			if !errors.As(err, &recErr) || !f.recover {
+				err = errors.Join(fmt.Errorf("%s: %w", f.fileName, err), r.Close())
+				return nil, err
+			}
+			damaged++
+			metrics.StorageDamagedRecords.Inc()
+			f.log.WithError(recErr.Err).WithFields(logrus.Fields{"file": f.fileName, "line": recErr.Line}).
+				Warn("Damaged storage record is skipped")
+			if err = q.write(f.fileName, recErr); err != nil {
+				return nil, errors.Join(err, r.Close())
+			}
+			continue
 		}
-		data[config.ShortKey([]byte(item.ShortURL))] = storeItem{
-			uuid: item.UUID,
-			url:  item.OriginalURL,
+		data[config.ShortKey(item.ShortURL)] = storeItem{
+			uuid:      item.UUID,
+			url:       item.OriginalURL,
+			userID:    item.UserID,
+			isDeleted: item.IsDeleted,
+			expiresAt: timeOrZero(item.ExpiresAt),
 		}
 	}
-	err = r.Close()
+	if err = r.Close(); err != nil {
+		return
+	}
+	if damaged > 0 {
+		f.log.WithFields(logrus.Fields{"file": f.fileName, "count": damaged, "quarantine": q.fileName}).
+			Warn("Damaged storage records are quarantined")
+	}
+	// the log rotated by the compaction not finished is older than the current one
+	walFile := f.fileName + constant.WALFileSuffix
+	if err = replayWAL(walFile+constant.WALRotatedSuffix, data, f.keys, f.recover, q, f.log); err != nil {
+		return nil, err
+	}
+	if err = replayWAL(walFile, data, f.keys, f.recover, q, f.log); err != nil {
+		return nil, err
+	}
 	return
 }
 
+// storageHeader is the first line of the storage file. The files of version 0 have no header
+// and no checksums, they are read as is and written in the current version on the next save
+type storageHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// storageRecord is the line of the storage file: the Item, or the Data of the item encrypted
+// with the key KeyID since version 2. CRC is the crc32 (IEEE) of the Item or Data bytes
+type storageRecord struct {
+	CRC   uint32          `json:"crc"`
+	Item  json.RawMessage `json:"item,omitempty"`
+	KeyID string          `json:"kid,omitempty"`
+	Data  []byte          `json:"data,omitempty"`
+}
+
+// RecordError is the damaged line of the storage file
+type RecordError struct {
+	Line int
+	Raw  []byte
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%s at line %d: %v", myErr.ErrDamagedRecord, e.Line, e.Err)
+}
+
+func (e *RecordError) Unwrap() []error {
+	return []error{myErr.ErrDamagedRecord, e.Err}
+}
+
 type Saver struct {
 	file    *os.File
 	encoder *json.Encoder
+	keys    *keyring.Keyring
 }
 
-func NewSaver(filename string) (*Saver, error) {
+// NewSaver truncates the file and writes the header of the current version.
+// With the keys, the records are encrypted with the active key
+func NewSaver(filename string, keys *keyring.Keyring) (*Saver, error) {
 	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, err
 	}
-
-	return &Saver{
+	s := &Saver{
 		file:    file,
 		encoder: json.NewEncoder(file),
-	}, nil
+		keys:    keys,
+	}
+	if err = s.encoder.Encode(storageHeader{Format: constant.StorageFormat, Version: constant.StorageVersion}); err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return s, nil
 }
 
 func (s *Saver) WriteData(data *FileStorageItem) error {
-	return s.encoder.Encode(data)
+	item, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if s.keys == nil {
+		return s.encoder.Encode(storageRecord{CRC: crc32.ChecksumIEEE(item), Item: item})
+	}
+	rec := storageRecord{}
+	if rec.KeyID, rec.Data, err = s.keys.Seal(item); err != nil {
+		return err
+	}
+	rec.CRC = crc32.ChecksumIEEE(rec.Data)
+	return s.encoder.Encode(rec)
 }
 
 func (s *Saver) Close() error {
@@ -117,25 +302,149 @@ func (s *Saver) Close() error {
 
 type Reader struct {
 	file    *os.File
-	decoder *json.Decoder
+	reader  *bufio.Reader
+	keys    *keyring.Keyring
+	version int
+	line    int
+	pending []byte
 }
 
-func NewReader(filename string) (*Reader, error) {
+// NewReader reads the header, the file with no header is of version 0.
+// The encrypted records are opened with the keys
+func NewReader(filename string, keys *keyring.Keyring) (*Reader, error) {
 	file, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return &Reader{
+	r := &Reader{
 		file:    file,
-		decoder: json.NewDecoder(file),
-	}, nil
+		reader:  bufio.NewReader(file),
+		keys:    keys,
+		version: constant.StorageVersion,
+	}
+	first, err := r.readLine()
+	if errors.Is(err, io.EOF) {
+		return r, nil
+	} else if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	var h storageHeader
+	if json.Unmarshal(first, &h) == nil && h.Format == constant.StorageFormat {
+		if h.Version > constant.StorageVersion || h.Version < 1 {
+			return nil, errors.Join(fmt.Errorf("%s: unsupported storage file version %d", filename, h.Version), file.Close())
+		}
+		r.version = h.Version
+		return r, nil
+	}
+	r.version, r.line, r.pending = 0, r.line-1, first
+	return r, nil
+}
+
+// readLine returns the next not empty line, io.EOF at the end
+func (r *Reader) readLine() (line []byte, err error) {
+	if r.pending != nil {
+		line, r.pending = r.pending, nil
+		r.line++
+		return
+	}
+	for {
+		line, err = r.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			r.line++
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *Reader) Version() int {
+	return r.version
 }
 
+// ReadData returns the next item, the damaged one is reported by *RecordError
+// and the next call goes on with the next line. The record of the key not in the keys
+// is not the damaged one, it is the keyring.ErrUnknownKey
 func (r *Reader) ReadData() (e *FileStorageItem, err error) {
-	err = r.decoder.Decode(&e)
+	var line []byte
+	if line, err = r.readLine(); err != nil {
+		return
+	}
+	damaged := func(err error) (*FileStorageItem, error) {
+		return nil, &RecordError{Line: r.line, Raw: line, Err: err}
+	}
+	item := line
+	if r.version > 0 {
+		var rec storageRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return damaged(err)
+		}
+		item = rec.Item
+		if rec.KeyID != "" {
+			item = rec.Data
+		}
+		if crc := crc32.ChecksumIEEE(item); crc != rec.CRC {
+			return damaged(fmt.Errorf("checksum %08x, expected %08x", crc, rec.CRC))
+		}
+		if rec.KeyID != "" {
+			if item, err = r.keys.Open(rec.KeyID, rec.Data); errors.Is(err, keyring.ErrUnknownKey) {
+				return nil, fmt.Errorf("line %d: %w", r.line, err)
+			} else if err != nil {
+				return damaged(err)
+			}
+		}
+	}
+	if err = json.Unmarshal(item, &e); err != nil {
+		return damaged(err)
+	}
+	if e == nil || e.ShortURL == "" {
+		return damaged(errors.New("no short url"))
+	}
 	return
 }
 
 func (r *Reader) Close() error {
 	return r.file.Close()
 }
+
+// quarantine appends the damaged records to the file next to the storage one
+type quarantine struct {
+	fileName string
+	file     *os.File
+	encoder  *json.Encoder
+}
+
+type quarantineRecord struct {
+	Time   time.Time `json:"time"`
+	File   string    `json:"file"`
+	Line   int       `json:"line"`
+	Error  string    `json:"error"`
+	Record string    `json:"record"`
+}
+
+func (q *quarantine) write(file string, e *RecordError) (err error) {
+	if q.file == nil {
+		if q.file, err = os.OpenFile(q.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			q.file = nil
+			return
+		}
+		q.encoder = json.NewEncoder(q.file)
+	}
+	return q.encoder.Encode(quarantineRecord{
+		Time:   time.Now(),
+		File:   file,
+		Line:   e.Line,
+		Error:  e.Err.Error(),
+		Record: string(e.Raw),
+	})
+}
+
+func (q *quarantine) close() error {
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/worker"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// keySource makes the unused short codes for the pool
+type keySource interface {
+	// next returns up to n codes not taken at the moment
+	next(ctx context.Context, n int) ([]config.ShortKey, error)
+	// release takes back the codes not handed out
+	release(ctx context.Context, keys []config.ShortKey) error
+	// used is the count of the codes taken by the storage
+	used(ctx context.Context) (float64, error)
+}
+
+// KeyPool hands out the pre-generated unused short codes of the reserve, refilled in background
+// when it is half empty. The code may be taken by an alias after it is made, so the storage
+// still retries on the collision. The empty reserve is not waited for, the storage generates the code
+type KeyPool struct {
+	source   keySource
+	gen      shortcode.CodeGenerator
+	reserve  chan config.ShortKey
+	log      logrus.FieldLogger
+	refill   *worker.Periodic
+	usedM    sync.Mutex
+	usedKeys float64
+}
+
+func newKeyPool(source keySource, gen shortcode.CodeGenerator, size int, timeout time.Duration, log logrus.FieldLogger) *KeyPool {
+	p := &KeyPool{
+		source:  source,
+		gen:     gen,
+		reserve: make(chan config.ShortKey, size),
+		log:     log,
+	}
+	p.refill = worker.NewPeriodic(constant.KeyPoolRefillInterval*time.Second, timeout, p.fill)
+	p.refill.Trigger()
+	return p
+}
+
+// Take returns the code of the reserve, false is the reserve is empty
+func (p *KeyPool) Take() (config.ShortKey, bool) {
+	select {
+	case k := <-p.reserve:
+		if len(p.reserve) < cap(p.reserve)/2 {
+			p.refill.Trigger()
+		}
+		return k, true
+	default:
+		p.refill.Trigger()
+		return "", false
+	}
+}
+
+// Reserve is the count of the codes ready to hand out
+func (p *KeyPool) Reserve() int {
+	return len(p.reserve)
+}
+
+// KeyspaceRemaining is the count of the codes the generator can make and the storage has not taken,
+// as of the last refill
+func (p *KeyPool) KeyspaceRemaining() float64 {
+	p.usedM.Lock()
+	defer p.usedM.Unlock()
+	return p.gen.Keyspace() - p.usedKeys
+}
+
+// fill tops up the reserve unless it is at least half full
+func (p *KeyPool) fill(ctx context.Context) {
+	if n := len(p.reserve); n > 0 && n >= cap(p.reserve)/2 {
+		return
+	}
+	keys, err := p.source.next(ctx, cap(p.reserve)-len(p.reserve))
+	if err != nil {
+		p.log.WithError(err).Error("Key pool refill")
+	}
+	var extra []config.ShortKey
+	for i, k := range keys {
+		select {
+		case p.reserve <- k:
+		default:
+			extra = keys[i:]
+		}
+		if extra != nil {
+			break
+		}
+	}
+	if len(extra) > 0 {
+		if err = p.source.release(ctx, extra); err != nil {
+			p.log.WithError(err).Error("Key pool release")
+		}
+	}
+	if used, err := p.source.used(ctx); err != nil {
+		p.log.WithError(err).Error("Key pool used keys")
+	} else {
+		p.usedM.Lock()
+		p.usedKeys = used
+		p.usedM.Unlock()
+	}
+}
+
+// Close stops the refill and gives the reserve back to the source
+func (p *KeyPool) Close(ctx context.Context) error {
+	if err := p.refill.Close(ctx); err != nil {
+		return err
+	}
+	var keys []config.ShortKey
+	for len(p.reserve) > 0 {
+		keys = append(keys, <-p.reserve)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return p.source.release(ctx, keys)
+}
+
+// memKeySource makes the codes not taken in the memory storage
+type memKeySource struct {
+	r   *MemStorageRepository
+	gen shortcode.CodeGenerator
+}
+
+func (s memKeySource) next(_ context.Context, n int) (keys []config.ShortKey, err error) {
+	keys = make([]config.ShortKey, 0, n)
+	for i := 0; i < n; i++ {
+		k := config.ShortKey(shortcode.Generate(s.gen, "", 0))
+		shard := s.r.dataShard(k)
+		shard.m.RLock()
+		_, taken := shard.data[k]
+		shard.m.RUnlock()
+		if !taken {
+			keys = append(keys, k)
+		}
+	}
+	return
+}
+
+func (s memKeySource) release(context.Context, []config.ShortKey) error {
+	return nil
+}
+
+func (s memKeySource) used(context.Context) (n float64, err error) {
+	for i := range s.r.data {
+		shard := &s.r.data[i]
+		shard.m.RLock()
+		n += float64(len(shard.data))
+		shard.m.RUnlock()
+	}
+	return
+}
+
+// dbKeySource claims the codes of the short_keys table, shared by the servers of the db.
+// The table is stocked in bulk with the codes not taken when it runs short
+type dbKeySource struct {
+	db    *sqlx.DB
+	gen   shortcode.CodeGenerator
+	stock int
+}
+
+func (s dbKeySource) next(ctx context.Context, n int) (keys []config.ShortKey, err error) {
+	if keys, err = s.claim(ctx, n); err != nil || len(keys) == n {
+		return
+	}
+	if err = s.fillStock(ctx); err != nil {
+		return
+	}
+	var more []config.ShortKey
+	more, err = s.claim(ctx, n-len(keys))
+	keys = append(keys, more...)
+	return
+}
+
+func (s dbKeySource) claim(ctx context.Context, n int) (keys []config.ShortKey, err error) {
+	sqlStr := `DELETE FROM ` + constant.DBShortKeysTableName + ` WHERE short IN
+ (SELECT short FROM ` + constant.DBShortKeysTableName + ` LIMIT $1 FOR UPDATE SKIP LOCKED) RETURNING short`
+	err = s.db.SelectContext(ctx, &keys, sqlStr, n)
+	return
+}
+
+func (s dbKeySource) fillStock(ctx context.Context) (err error) {
+	candidates := make([]string, s.stock)
+	for i := range candidates {
+		candidates[i] = shortcode.Generate(s.gen, "", 0)
+	}
+	sqlStr := `INSERT INTO ` + constant.DBShortKeysTableName + ` (short)
+ SELECT k FROM unnest($1::varchar[]) AS k
+ WHERE NOT EXISTS (SELECT 1 FROM ` + constant.DBTableName + ` WHERE short = k)
+ ON CONFLICT DO NOTHING`
+	_, err = s.db.ExecContext(ctx, sqlStr, candidates)
+	return
+}
+
+func (s dbKeySource) release(ctx context.Context, keys []config.ShortKey) (err error) {
+	shorts := make([]string, len(keys))
+	for i, k := range keys {
+		shorts[i] = k.String()
+	}
+	sqlStr := `INSERT INTO ` + constant.DBShortKeysTableName + ` (short)
+ SELECT unnest($1::varchar[]) ON CONFLICT DO NOTHING`
+	_, err = s.db.ExecContext(ctx, sqlStr, shorts)
+	return
+}
+
+// used is the planner estimate of the rows, the exact count is too slow for the big table
+func (s dbKeySource) used(ctx context.Context) (n float64, err error) {
+	err = s.db.GetContext(ctx, &n, `SELECT GREATEST(reltuples, 0) FROM pg_class WHERE relname = $1`, constant.DBTableName)
+	return
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPool(t *testing.T) {
+	t.Run("codes are taken from the pool", func(t *testing.T) {
+		gen, err := shortcode.New(constant.ShortGeneratorRandom, "0123456789", 5)
+		require.NoError(t, err)
+		r := NewRepository(Config{Generator: gen, KeyPoolSize: 50, Log: testLog()})
+		require.NotNil(t, r.KeyPool)
+		defer func() { assert.NoError(t, r.KeyPool.Close(context.TODO())) }()
+		require.Eventually(t, func() bool { return r.KeyPool.Reserve() == 50 }, 2*time.Second, 10*time.Millisecond)
+
+		shorts := make(map[string]bool)
+		for i := 0; i < 120; i++ {
+			short, err := r.NewShort(context.TODO(), domain.CreateURL{URL: fmt.Sprintf("https://pool.example/%d", i)})
+			require.NoError(t, err)
+			assert.Regexp(t, `^[0-9]{5}$`, short)
+			assert.False(t, shorts[short], "short %s is handed out twice", short)
+			shorts[short] = true
+		}
+
+		assert.Eventually(t, func() bool {
+			return r.KeyPool.Reserve() > 25 && r.KeyPool.KeyspaceRemaining() == gen.Keyspace()-120
+		}, 2*time.Second, 10*time.Millisecond)
+
+		reg := metrics.NewRegistry()
+		metrics.RegisterKeyPool(reg, r.KeyPool)
+		var b strings.Builder
+		require.NoError(t, reg.Write(&b))
+		assert.Contains(t, b.String(), "shortener_key_pool_reserve ")
+		assert.Contains(t, b.String(), "shortener_keyspace_remaining 99880")
+	})
+
+	t.Run("no pool", func(t *testing.T) {
+		for _, kind := range []string{constant.ShortGeneratorHash, constant.ShortGeneratorSortable} {
+			gen, err := shortcode.New(kind, constant.ShortAlphabet, constant.ShortLen)
+			require.NoError(t, err)
+			assert.Nil(t, NewRepository(Config{Generator: gen, KeyPoolSize: 50, Log: testLog()}).KeyPool, kind)
+		}
+		assert.Nil(t, NewRepository(Config{Log: testLog()}).KeyPool)
+	})
+}
@@ -2,63 +2,203 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
 	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/helper"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/logger"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
 
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
+type dataShard struct {
+	m    sync.RWMutex
+	data Store
+}
+
+// urlShard is the reverse index of the url to its shorts not deleted, the first one not expired is found.
+// The new url gets the one short, more may come with the restored data
+type urlShard struct {
+	m    sync.RWMutex
+	urls map[string][]urlRef
+}
+
+// urlRef is the short of the url with its expiry, so the expired one is skipped without the data shard
+type urlRef struct {
+	short     config.ShortKey
+	expiresAt time.Time
+}
+
+// live returns the first short of refs not expired
+func live(refs []urlRef, now time.Time) (config.ShortKey, bool) {
+	for _, ref := range refs {
+		if ref.expiresAt.IsZero() || ref.expiresAt.After(now) {
+			return ref.short, true
+		}
+	}
+	return "", false
+}
+
+// MemStorageRepository keeps the data in memory, sharded by the short, with the reverse index
+// sharded by the url. The data shard is locked before the url one. With the wal set,
+// every change is appended to it before it is applied
 type MemStorageRepository struct {
-	Data Store
-	mg   sync.RWMutex
+	data [constant.MemShards]dataShard
+	urls [constant.MemShards]urlShard
+	gen  shortcode.CodeGenerator
+	pool *KeyPool
+	wal  *WAL
+	log  logrus.FieldLogger
+}
+
+func NewMemRepository(gen shortcode.CodeGenerator, log logrus.FieldLogger) *MemStorageRepository {
+	r := &MemStorageRepository{
+		gen: gen,
+		log: log,
+	}
+	r.reset()
+	return r
+}
+
+func (r *MemStorageRepository) reset() {
+	for i := range r.data {
+		r.data[i].data = make(Store)
+		r.urls[i].urls = make(map[string][]urlRef)
+	}
+}
+
+// shardOf is the fnv-1a hash of s modulo the shards count
+func shardOf(s string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return int(h % constant.MemShards)
+}
+
+func (r *MemStorageRepository) dataShard(sk config.ShortKey) *dataShard {
+	return &r.data[shardOf(string(sk))]
+}
+
+func (r *MemStorageRepository) urlShard(url string) *urlShard {
+	return &r.urls[shardOf(url)]
 }
 
-func NewMemRepository() *MemStorageRepository {
-	return &MemStorageRepository{
-		Data: make(Store),
+func (r *MemStorageRepository) unindex(url string, sk config.ShortKey) {
+	s := r.urlShard(url)
+	s.m.Lock()
+	defer s.m.Unlock()
+	shorts := s.urls[url]
+	for i := range shorts {
+		if shorts[i].short == sk {
+			shorts = append(shorts[:i], shorts[i+1:]...)
+			break
+		}
+	}
+	if len(shorts) == 0 {
+		delete(s.urls, url)
+	} else {
+		s.urls[url] = shorts
+	}
+}
+
+// nextShort is the code of the pool, if any, or the generated one, not the reserved one
+func (r *MemStorageRepository) nextShort(url string, attempt int) config.ShortKey {
+	if r.pool != nil {
+		if k, ok := r.pool.Take(); ok {
+			return k
+		}
 	}
+	return config.ShortKey(shortcode.Generate(r.gen, url, attempt))
 }
 
 func (r *MemStorageRepository) Ping(ctx context.Context) (err error) {
 	return
 }
 
-func (r *MemStorageRepository) NewShort(ctx context.Context, url string) (short string, err error) {
-	r.mg.Lock()
-	defer r.mg.Unlock()
-	for {
+// insert stores the item when the short is free and the url is not stored live, false is the short taken.
+// The url shard is held from the check to the index, so the url is stored once.
+// The stored url returns its short with myErr.ErrAlreadyExist
+func (r *MemStorageRepository) insert(sk config.ShortKey, item storeItem) (short config.ShortKey, ok bool, err error) {
+	s := r.dataShard(sk)
+	s.m.Lock()
+	defer s.m.Unlock()
+	u := r.urlShard(item.url)
+	u.m.Lock()
+	defer u.m.Unlock()
+	if short, ok := live(u.urls[item.url], time.Now()); ok {
+		return short, false, myErr.ErrAlreadyExist
+	}
+	if _, exist := s.data[sk]; exist {
+		return
+	}
+	if err = r.journal(walOpPut, sk, item); err != nil {
+		return
+	}
+	s.data[sk] = item
+	u.urls[item.url] = append(u.urls[item.url], urlRef{short: sk, expiresAt: item.expiresAt})
+	return sk, true, nil
+}
+
+func (r *MemStorageRepository) NewShort(ctx context.Context, in domain.CreateURL) (short string, err error) {
+	item := storeItem{
+		uuid:      uuid.New().String(),
+		url:       in.URL,
+		userID:    helper.UserIDFromContext(ctx),
+		expiresAt: timeOrZero(in.ExpiresAt),
+	}
+	if in.Alias != "" {
+		var (
+			sk config.ShortKey
+			ok bool
+		)
+		if sk, ok, err = r.insert(config.ShortKey(in.Alias), item); err == nil && !ok {
+			err = myErr.ErrAliasTaken
+		}
+		short = sk.String()
+		return
+	}
+	for attempt := 0; ; attempt++ {
 		select {
 		case <-ctx.Done():
 			err = ctx.Err()
 			return
 		default:
-			newShort := helper.NewRandShorter().RandStringBytes()
-			if _, exist := r.Data[newShort]; !exist {
-				r.Data[newShort] = storeItem{
-					uuid: uuid.New().String(),
-					url:  url,
-				}
-				short = newShort.String()
+			newShort := r.nextShort(in.URL, attempt)
+			var (
+				sk config.ShortKey
+				ok bool
+			)
+			if sk, ok, err = r.insert(newShort, item); err != nil || ok {
+				short = sk.String()
 				return
 			}
+			metrics.ShortCollisions.Inc("mem")
+			logger.FromContext(ctx, r.log).WithField("short", newShort).Debug("Short collision, retry")
 		}
 	}
 }
 
 func (r *MemStorageRepository) GetFromShort(ctx context.Context, k string) (v string, err error) {
-	if len([]byte(k)) != len(config.ShortKey{}) {
-		err = myErr.ErrNotExist
-		return
-	}
-	sk := config.ShortKey([]byte(k))
-	r.mg.RLock()
-	defer r.mg.RUnlock()
-	if item, ok := r.Data[sk]; !ok {
+	sk := config.ShortKey(k)
+	s := r.dataShard(sk)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if item, ok := s.data[sk]; !ok {
 		err = myErr.ErrNotExist
+	} else if item.isDeleted {
+		err = myErr.ErrIsDeleted
+	} else if item.isExpired(time.Now()) {
+		err = myErr.ErrExpired
 	} else {
 		v = item.url
 	}
@@ -66,36 +206,97 @@ func (r *MemStorageRepository) GetFromShort(ctx context.Context, k string) (v st
 }
 
 func (r *MemStorageRepository) GetFromURL(ctx context.Context, url string) (v string, err error) {
-	r.mg.Lock()
-	defer r.mg.Unlock()
-	for sk, item := range r.Data {
-		if item.url == url {
-			return sk.String(), nil
-		}
+	s := r.urlShard(url)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if short, ok := live(s.urls[url], time.Now()); ok {
+		v = short.String()
 	}
-
 	return
 }
 
+// journal appends the change to the wal, if any
+func (r *MemStorageRepository) journal(op string, sk config.ShortKey, item storeItem) error {
+	if r.wal == nil {
+		return nil
+	}
+	return r.wal.Append(WALRecord{Op: op, FileStorageItem: newFileStorageItem(sk, item)})
+}
+
+// GetAll returns the copy of the data, safe to read while the storage is changed
 func (r *MemStorageRepository) GetAll(ctx context.Context) (Store, error) {
-	return r.Data, nil
+	data := make(Store)
+	for i := range r.data {
+		s := &r.data[i]
+		s.m.RLock()
+		for sk, item := range s.data {
+			data[sk] = item
+		}
+		s.m.RUnlock()
+	}
+	return data, nil
 }
 
+// RestoreAll replaces the data, it is called before the storage is used
 func (r *MemStorageRepository) RestoreAll(data Store) error {
-	r.Data = data
+	for i := range r.data {
+		r.data[i].m.Lock()
+	}
+	for i := range r.urls {
+		r.urls[i].m.Lock()
+	}
+	r.reset()
+	for sk, item := range data {
+		r.dataShard(sk).data[sk] = item
+		if item.isDeleted {
+			continue
+		}
+		s := r.urlShard(item.url)
+		s.urls[item.url] = append(s.urls[item.url], urlRef{short: sk, expiresAt: item.expiresAt})
+	}
+	for i := range r.data {
+		r.urls[i].m.Unlock()
+		r.data[i].m.Unlock()
+	}
 	return nil
 }
 
+func (r *MemStorageRepository) NewShortBatchPartial(ctx context.Context, input []domain.ShortBatchInputItem, prefix string) (out []domain.ShortBatchResultItem, err error) {
+	out = make([]domain.ShortBatchResultItem, len(input))
+	for n, i := range input {
+		out[n].CorrelationTD = i.CorrelationID
+		var short string
+		short, out[n].Err = r.NewShort(ctx, domain.CreateURL{URL: i.OriginalURL, Alias: i.Alias, ExpiresAt: i.ExpiresAt})
+		switch {
+		case out[n].Err == nil, errors.Is(out[n].Err, myErr.ErrAlreadyExist):
+			out[n].ShortURL = prefix + short
+		case !errors.Is(out[n].Err, myErr.ErrAliasTaken):
+			return nil, out[n].Err
+		}
+	}
+	return
+}
+
+// NewShortBatch creates the shorts of the input, the failed item removes the ones the batch created,
+// as the db transaction is rolled back
 func (r *MemStorageRepository) NewShortBatch(ctx context.Context, input []domain.ShortBatchInputItem, prefix string) (out []domain.ShortBatchResultItem, err error) {
+	var created []config.ShortKey
+	defer func() {
+		if err != nil {
+			out = nil
+			if errU := r.remove(created); errU != nil {
+				err = errors.Join(err, errU)
+			}
+		}
+	}()
 	for _, i := range input {
 		var short string
-		if short, err = r.GetFromURL(ctx, i.OriginalURL); err != nil {
+		if short, err = r.NewShort(ctx, domain.CreateURL{URL: i.OriginalURL, Alias: i.Alias, ExpiresAt: i.ExpiresAt}); errors.Is(err, myErr.ErrAlreadyExist) {
+			err = nil
+		} else if err != nil {
 			return
-		}
-		if short == "" {
-			if short, err = r.NewShort(ctx, i.OriginalURL); err != nil {
-				return
-			}
+		} else {
+			created = append(created, config.ShortKey(short))
 		}
 		out = append(out, domain.ShortBatchResultItem{
 			CorrelationTD: i.CorrelationID,
@@ -104,3 +305,132 @@ func (r *MemStorageRepository) NewShortBatch(ctx context.Context, input []domain
 	}
 	return
 }
+
+func (r *MemStorageRepository) GetUserURLs(ctx context.Context, prefix string) (out []domain.UserURLItem, err error) {
+	userID := helper.UserIDFromContext(ctx)
+	if userID == "" {
+		return
+	}
+	now := time.Now()
+	for i := range r.data {
+		s := &r.data[i]
+		s.m.RLock()
+		for sk, item := range s.data {
+			if item.userID == userID && !item.isDeleted && !item.isExpired(now) {
+				out = append(out, domain.UserURLItem{
+					ShortURL:    prefix + sk.String(),
+					OriginalURL: item.url,
+				})
+			}
+		}
+		s.m.RUnlock()
+	}
+	return
+}
+
+// DeleteURLs marks the items of their users deleted, the wal gets the records of the shard at once
+func (r *MemStorageRepository) DeleteURLs(ctx context.Context, items []domain.DeleteURLItem) (err error) {
+	byShard := make(map[int][]domain.DeleteURLItem)
+	for _, i := range items {
+		n := shardOf(i.Short)
+		byShard[n] = append(byShard[n], i)
+	}
+	for n, shardItems := range byShard {
+		if err = r.deleteURLs(&r.data[n], shardItems); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *MemStorageRepository) deleteURLs(s *dataShard, items []domain.DeleteURLItem) (err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var records []WALRecord
+	for _, i := range items {
+		sk := config.ShortKey(i.Short)
+		if item, ok := s.data[sk]; ok && item.userID == i.UserID && !item.isDeleted {
+			records = append(records, WALRecord{Op: walOpDelete, FileStorageItem: FileStorageItem{ShortURL: sk.String(), UserID: item.userID}})
+		}
+	}
+	if r.wal != nil && len(records) > 0 {
+		if err = r.wal.Append(records...); err != nil {
+			return
+		}
+	}
+	for _, rec := range records {
+		sk := config.ShortKey(rec.ShortURL)
+		item := s.data[sk]
+		item.isDeleted = true
+		s.data[sk] = item
+		// the deleted url is free to be shortened again
+		r.unindex(item.url, sk)
+	}
+	return
+}
+
+// PurgeExpired removes the expired items, the wal gets the records of the shard at once,
+// so the replay does not bring them back
+func (r *MemStorageRepository) PurgeExpired(ctx context.Context) (n int64, err error) {
+	now := time.Now()
+	for i := range r.data {
+		var purged int64
+		if purged, err = r.purgeExpired(&r.data[i], now); err != nil {
+			return
+		}
+		n += purged
+	}
+	return
+}
+
+func (r *MemStorageRepository) purgeExpired(s *dataShard, now time.Time) (n int64, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var shorts []config.ShortKey
+	for sk, item := range s.data {
+		if item.isExpired(now) {
+			shorts = append(shorts, sk)
+		}
+	}
+	if err = r.purge(s, shorts); err == nil {
+		n = int64(len(shorts))
+	}
+	return
+}
+
+// remove purges the items of the shorts
+func (r *MemStorageRepository) remove(shorts []config.ShortKey) (err error) {
+	byShard := make(map[int][]config.ShortKey)
+	for _, sk := range shorts {
+		n := shardOf(string(sk))
+		byShard[n] = append(byShard[n], sk)
+	}
+	for n, shardShorts := range byShard {
+		s := &r.data[n]
+		s.m.Lock()
+		err = r.purge(s, shardShorts)
+		s.m.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// purge removes the items of the locked shard, the wal gets their records at once
+func (r *MemStorageRepository) purge(s *dataShard, shorts []config.ShortKey) (err error) {
+	if r.wal != nil && len(shorts) > 0 {
+		records := make([]WALRecord, len(shorts))
+		for i, sk := range shorts {
+			records[i] = WALRecord{Op: walOpPurge, FileStorageItem: FileStorageItem{ShortURL: sk.String()}}
+		}
+		if err = r.wal.Append(records...); err != nil {
+			return
+		}
+	}
+	for _, sk := range shorts {
+		r.unindex(s.data[sk].url, sk)
+		delete(s.data, sk)
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the sizes the creation and the lookups are expected to stay flat at
+var benchSizes = []int{10_000, 100_000, 1_000_000}
+
+func benchURL(i int) string {
+	return "https://bench.example/" + strconv.Itoa(i)
+}
+
+func filledMemRepository(b *testing.B, n int) *MemStorageRepository {
+	b.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	r := NewMemRepository(shortcode.Default(), log)
+	data := make(Store, n)
+	for i := 0; i < n; i++ {
+		data[config.ShortKey("s"+strconv.Itoa(i))] = storeItem{url: benchURL(i)}
+	}
+	if err := r.RestoreAll(data); err != nil {
+		b.Fatal(err)
+	}
+	return r
+}
+
+func BenchmarkMemStorageRepository_NewShort(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			r := filledMemRepository(b, n)
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.NewShort(ctx, domain.CreateURL{URL: benchURL(n + i)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMemStorageRepository_GetFromURL(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			r := filledMemRepository(b, n)
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if short, _ := r.GetFromURL(ctx, benchURL(rand.Intn(n))); short == "" {
+					b.Fatal("url is not found")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemStorageRepository_Parallel mixes the redirects with 1 creation of 10
+func BenchmarkMemStorageRepository_Parallel(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			r := filledMemRepository(b, n)
+			ctx := context.Background()
+			// the created urls are new, the stored one is ErrAlreadyExist
+			var created atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					i := rnd.Intn(n)
+					if i%10 == 0 {
+						if _, err := r.NewShort(ctx, domain.CreateURL{URL: benchURL(n + int(created.Add(1)))}); err != nil {
+							b.Error(err)
+						}
+						continue
+					}
+					if _, err := r.GetFromShort(ctx, "s"+strconv.Itoa(i)); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestMemStorageRepository_NewShortBatch(t *testing.T) {
+	storageFile := t.TempDir() + "/storage.json"
+	w := NewWAL(storageFile+constant.WALFileSuffix, constant.WALSyncNever, nil, testLog())
+	r := NewMemRepository(shortcode.Default(), testLog())
+	r.wal = w
+	ctx := context.Background()
+
+	_, err := r.NewShort(ctx, domain.CreateURL{URL: "https://taken.example/", Alias: "taken"})
+	require.NoError(t, err)
+	_, err = r.NewShortBatch(ctx, []domain.ShortBatchInputItem{
+		{CorrelationID: "1", OriginalURL: "https://first.example/"},
+		{CorrelationID: "2", OriginalURL: "https://taken.example/"},
+		{CorrelationID: "3", OriginalURL: "https://alias.example/", Alias: "taken"},
+	}, "")
+	require.ErrorIs(t, err, myErr.ErrAliasTaken)
+
+	// the items created before the failed one are removed
+	short, err := r.GetFromURL(ctx, "https://first.example/")
+	require.NoError(t, err)
+	assert.Empty(t, short)
+	short, err = r.GetFromURL(ctx, "https://taken.example/")
+	require.NoError(t, err)
+	assert.Equal(t, "taken", short, "the item stored before the batch is kept")
+
+	require.NoError(t, w.Close())
+	data, err := NewFileStorage(storageFile, testLog()).Restore()
+	require.NoError(t, err)
+	assert.Len(t, data, 1)
+}
+
+func TestMemStorageRepository_NewShortCollision(t *testing.T) {
+	gen, err := shortcode.New(constant.ShortGeneratorHash, constant.ShortAlphabet, constant.ShortLen)
+	require.NoError(t, err)
+	r := NewMemRepository(gen, testLog())
+	ctx := context.Background()
+	url := "https://collision.example/"
+
+	// the alias takes the first code of the url, the next attempt is stored
+	_, err = r.NewShort(ctx, domain.CreateURL{URL: url + "alias", Alias: gen.Generate(url, 0)})
+	require.NoError(t, err)
+	short, err := r.NewShort(ctx, domain.CreateURL{URL: url})
+	require.NoError(t, err)
+	assert.Equal(t, gen.Generate(url, 1), short)
+	got, err := r.GetFromShort(ctx, short)
+	require.NoError(t, err)
+	assert.Equal(t, url, got)
+}
@@ -2,8 +2,15 @@ package repository
 
 import (
 	"context"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+
 	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
 )
 
 //go:generate  mockgen -destination=../mock/repository/repository.go -package=mock "github.com/MrSwed/go-musthave-shortener/internal/app/repository" Repository
@@ -11,38 +18,103 @@ import (
 type DataStorage interface {
 	GetFromShort(ctx context.Context, k string) (string, error)
 	GetFromURL(ctx context.Context, url string) (string, error)
-	NewShort(ctx context.Context, url string) (newURL string, err error)
+	// NewShort stores the url, the url stored before returns its short with myErr.ErrAlreadyExist
+	NewShort(ctx context.Context, in domain.CreateURL) (newURL string, err error)
 	GetAll(ctx context.Context) (Store, error)
 	RestoreAll(Store) error
 	NewShortBatch(context.Context, []domain.ShortBatchInputItem, string) ([]domain.ShortBatchResultItem, error)
+	// NewShortBatchPartial stores the batch items apart, the item of the taken alias or the url stored before
+	// gets myErr.ErrAliasTaken or myErr.ErrAlreadyExist as its Err
+	NewShortBatchPartial(context.Context, []domain.ShortBatchInputItem, string) ([]domain.ShortBatchResultItem, error)
+	GetUserURLs(ctx context.Context, prefix string) ([]domain.UserURLItem, error)
+	DeleteURLs(ctx context.Context, items []domain.DeleteURLItem) error
+	PurgeExpired(ctx context.Context) (int64, error)
 	Ping(ctx context.Context) error
 }
 
 type Repository interface {
 	DataStorage
 	FileStorage
+	ClickStorage
+	StatsStorage
 }
 
 type Storage struct {
 	DataStorage
 	FileStorage
+	ClickStorage
+	StatsStorage
+	// KeyPool is nil when the codes are generated on demand
+	KeyPool *KeyPool
 }
 
 type Config struct {
 	StorageFile string
-	DB          *sqlx.DB
+	WALSync     string
+	Recover     bool
+	Keys        *keyring.Keyring
+	Generator   shortcode.CodeGenerator
+	KeyPoolSize int
+	// OperationTimeout bounds the background storage operations, as the key pool refill
+	OperationTimeout time.Duration
+	DB               *sqlx.DB
+	Log              logrus.FieldLogger
 }
 
+// NewRepository makes the db storage when c.DB is set and the memory one otherwise.
+// The memory storage with the storage file logs its changes to the wal, synced by c.WALSync.
+// With c.Recover, the damaged records of the storage file are skipped on restore.
+// With c.Keys, the storage file and the wal are encrypted.
+// With c.KeyPoolSize and the generator making the codes ahead, the codes are taken from the key pool.
+// Nil c.Log is the standard logger, nil c.Generator is shortcode.Default,
+// zero c.OperationTimeout is constant.ServerOperationTimeout
 func NewRepository(c Config) (s Storage) {
+	if c.Log == nil {
+		c.Log = logrus.StandardLogger()
+	}
+	if c.OperationTimeout == 0 {
+		c.OperationTimeout = constant.ServerOperationTimeout * time.Second
+	}
+	if c.Generator == nil {
+		c.Generator = shortcode.Default()
+	}
+	fileStorage := NewFileStorage(c.StorageFile, c.Log)
+	fileStorage.recover = c.Recover
+	fileStorage.keys = c.Keys
 	if c.DB != nil {
+		clicks := NewDBClickStorage(c.DB)
+		db := NewDBStorageRepository(c.DB, c.Generator, c.Log)
 		s = Storage{
-			FileStorage: NewFileStorage(c.StorageFile),
-			DataStorage: NewDBStorageRepository(c.DB),
+			FileStorage:  fileStorage,
+			DataStorage:  db,
+			ClickStorage: clicks,
+			StatsStorage: clicks,
+		}
+		if c.KeyPoolSize > 0 && c.Generator.Poolable() {
+			db.pool = newKeyPool(dbKeySource{db: c.DB, gen: c.Generator, stock: c.KeyPoolSize}, c.Generator, c.KeyPoolSize, c.OperationTimeout, c.Log)
+			s.KeyPool = db.pool
 		}
 	} else {
+		mem := NewMemRepository(c.Generator, c.Log)
 		s = Storage{
-			FileStorage: NewFileStorage(c.StorageFile),
-			DataStorage: NewMemRepository(),
+			FileStorage: fileStorage,
+			DataStorage: mem,
+		}
+		if c.KeyPoolSize > 0 && c.Generator.Poolable() {
+			mem.pool = newKeyPool(memKeySource{r: mem, gen: c.Generator}, c.Generator, c.KeyPoolSize, c.OperationTimeout, c.Log)
+			s.KeyPool = mem.pool
+		}
+		if c.StorageFile != "" {
+			if c.WALSync == "" {
+				c.WALSync = constant.WALSync
+			}
+			fileStorage.wal = NewWAL(c.StorageFile+constant.WALFileSuffix, c.WALSync, c.Keys, c.Log)
+			mem.wal = fileStorage.wal
+			clicks := NewFileClickStorage(c.StorageFile+constant.ClickFileSuffix, c.Log)
+			s.ClickStorage, s.StatsStorage = clicks, clicks
+		} else {
+			clicks := NewMemClickStorage(constant.ClickMemMaxCount)
+			s.ClickStorage, s.StatsStorage = clicks, clicks
 		}
 	}
 	return s
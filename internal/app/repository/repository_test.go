@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_Log(t *testing.T) {
+	storageFile := t.TempDir() + "/storage.json"
+	walFile := storageFile + constant.WALFileSuffix
+
+	// restore makes the storage like after the restart, with no save on shutdown
+	restore := func() Storage {
+		r := NewRepository(Config{StorageFile: storageFile, Log: testLog()})
+		data, err := r.Restore()
+		require.NoError(t, err)
+		require.NoError(t, r.RestoreAll(data))
+		return r
+	}
+	created := func(r Storage, url string) string {
+		short, err := r.NewShort(context.TODO(), domain.CreateURL{URL: url})
+		require.NoError(t, err)
+		return short
+	}
+	getURL := func(r Storage, short string) string {
+		url, err := r.GetFromShort(context.TODO(), short)
+		require.NoError(t, err)
+		return url
+	}
+
+	r := restore()
+	short1 := created(r, "https://wal-1.example/")
+	short2 := created(r, "https://wal-2.example/")
+	require.NoError(t, r.DeleteURLs(context.TODO(), []domain.DeleteURLItem{{Short: short2}}))
+
+	r = restore()
+	assert.Equal(t, "https://wal-1.example/", getURL(r, short1))
+	_, err := r.GetFromShort(context.TODO(), short2)
+	assert.ErrorIs(t, err, myErr.ErrIsDeleted)
+
+	// compaction moves the log to the storage file
+	require.NoError(t, r.Compact(context.TODO(), r.GetAll))
+	_, err = os.Stat(walFile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	short3 := created(r, "https://wal-3.example/")
+
+	// the torn tail of the crash is cut off, the next records are replayed
+	file, err := os.OpenFile(walFile, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"put","short_url":"torn`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	r = restore()
+	assert.Equal(t, "https://wal-1.example/", getURL(r, short1))
+	assert.Equal(t, "https://wal-3.example/", getURL(r, short3))
+	short4 := created(r, "https://wal-4.example/")
+
+	r = restore()
+	assert.Equal(t, "https://wal-3.example/", getURL(r, short3))
+	assert.Equal(t, "https://wal-4.example/", getURL(r, short4))
+}
+
+func TestStorage_Restore(t *testing.T) {
+	storageFile := t.TempDir() + "/storage.json"
+	restore := func(recover bool) (Store, error) {
+		return NewRepository(Config{StorageFile: storageFile, Recover: recover, Log: testLog()}).Restore()
+	}
+
+	// the headerless file of version 0 is loaded and upgraded on save
+	require.NoError(t, os.WriteFile(storageFile, []byte(
+		`{"uuid":"1","short_url":"restore1","original_url":"https://restore-1.example/"}`+"\n"+
+			`{"uuid":"2","short_url":"restore2","original_url":"https://restore-2.example/"}`+"\n"), 0644))
+	data, err := restore(false)
+	require.NoError(t, err)
+	assert.Len(t, data, 2)
+
+	require.NoError(t, NewRepository(Config{StorageFile: storageFile, Log: testLog()}).Save(data))
+	content, err := os.ReadFile(storageFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 3)
+	assert.JSONEq(t, `{"format":"shortener-storage","version":2}`, lines[0])
+	data, err = restore(false)
+	require.NoError(t, err)
+	assert.Len(t, data, 2)
+
+	// the record changed is caught by the checksum, the broken line by json
+	lines[1] = strings.Replace(lines[1], "restore-", "changed-", 1)
+	lines = append(lines, `{"crc":1,"item":{"short_url"`)
+	require.NoError(t, os.WriteFile(storageFile, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	_, err = restore(false)
+	assert.ErrorIs(t, err, myErr.ErrDamagedRecord)
+
+	data, err = restore(true)
+	require.NoError(t, err)
+	assert.Len(t, data, 1)
+	quarantine, err := os.ReadFile(storageFile + constant.StorageQuarantineSuffix)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(quarantine)), "\n"), 2)
+	assert.Contains(t, string(quarantine), "changed-")
+
+	require.NoError(t, os.WriteFile(storageFile, []byte(`{"format":"shortener-storage","version":99}`+"\n"), 0644))
+	_, err = restore(true)
+	assert.ErrorContains(t, err, "unsupported storage file version 99")
+}
+
+func TestStorage_Encryption(t *testing.T) {
+	storageFile := t.TempDir() + "/storage.json"
+	key1, err := keyring.Parse("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, err)
+	// the rotated keyring encrypts with k2 and still reads k1
+	key21, err := keyring.Parse("k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16)) +
+		",k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, err)
+	key2, err := keyring.Parse("k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16)))
+	require.NoError(t, err)
+
+	newRepository := func(keys *keyring.Keyring) Storage {
+		return NewRepository(Config{StorageFile: storageFile, Keys: keys, Log: testLog()})
+	}
+	newShort := func(r Storage, url string) string {
+		short, err := r.NewShort(context.TODO(), domain.CreateURL{URL: url})
+		require.NoError(t, err)
+		return short
+	}
+	secretURL := "https://encrypted.example/?token=secret-token"
+
+	r := newRepository(key1)
+	short := newShort(r, secretURL)
+	savedShort := newShort(r, secretURL+"-saved")
+	require.NoError(t, r.Compact(context.TODO(), r.GetAll))
+	short3 := newShort(r, secretURL+"-log")
+	require.NoError(t, r.Close())
+
+	for _, name := range []string{storageFile, storageFile + constant.WALFileSuffix} {
+		content, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "secret-token", name)
+		assert.Contains(t, string(content), `"kid":"k1"`, name)
+	}
+
+	_, err = newRepository(nil).Restore()
+	assert.ErrorIs(t, err, keyring.ErrUnknownKey)
+	_, err = newRepository(key2).Restore()
+	assert.ErrorIs(t, err, keyring.ErrUnknownKey)
+
+	// re-encrypt: read with the rotated keyring, compact with k2
+	r = newRepository(key21)
+	data, err := r.Restore()
+	require.NoError(t, err)
+	require.NoError(t, r.Compact(context.TODO(), func(context.Context) (Store, error) { return data, nil }))
+	require.NoError(t, r.Close())
+
+	r = newRepository(key2)
+	data, err = r.Restore()
+	require.NoError(t, err)
+	require.NoError(t, r.RestoreAll(data))
+	for short, url := range map[string]string{short: secretURL, savedShort: secretURL + "-saved", short3: secretURL + "-log"} {
+		got, err := r.GetFromShort(context.TODO(), short)
+		require.NoError(t, err)
+		assert.Equal(t, url, got)
+	}
+	_, err = os.Stat(storageFile + constant.WALFileSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestStore_CanonicalURLs(t *testing.T) {
+	data := Store{
+		"a": {url: "HTTPS://A.EXAMPLE/"},
+		"b": {url: "https://b.example/"},
+		"c": {url: "HTTPS://B.EXAMPLE/"},
+		"d": {url: "HTTPS://D.EXAMPLE/", isDeleted: true},
+		"e": {url: "not canonical"},
+	}
+	changed := data.CanonicalURLs(func(url string) (string, error) {
+		if !strings.HasPrefix(url, "HTTPS://") {
+			return url, errors.New("not a url")
+		}
+		return strings.ToLower(url), nil
+	})
+	assert.Equal(t, 2, changed)
+	assert.Equal(t, "https://a.example/", data["a"].url)
+	assert.Equal(t, "HTTPS://B.EXAMPLE/", data["c"].url, "the canonical url is stored by the other item")
+	assert.Equal(t, "https://d.example/", data["d"].url)
+	assert.Equal(t, "not canonical", data["e"].url)
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+)
+
+type StatsStorage interface {
+	GetStats(ctx context.Context, short string, q domain.StatsQuery) (domain.Stats, error)
+}
+
+func (s *MemClickStorage) GetStats(ctx context.Context, short string, q domain.StatsQuery) (domain.Stats, error) {
+	a := newStatsAccumulator(short, q)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for _, c := range s.clicks {
+		a.add(c)
+	}
+	return a.result(), nil
+}
+
+func (s *FileClickStorage) GetStats(ctx context.Context, short string, q domain.StatsQuery) (stats domain.Stats, err error) {
+	s.m.Lock()
+	err = s.load()
+	s.m.Unlock()
+	if err != nil {
+		return
+	}
+	a := newStatsAccumulator(short, q)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for _, c := range s.clicks[short] {
+		a.add(c)
+	}
+	stats = a.result()
+	return
+}
+
+func (s *DBClickStorage) GetStats(ctx context.Context, short string, q domain.StatsQuery) (stats domain.Stats, err error) {
+	var (
+		from   = nullTime(q.From)
+		to     = nullTime(q.To)
+		where  = ` FROM ` + constant.DBClicksTableName + ` WHERE short = $1 AND ($2::timestamptz IS NULL OR created_at >= $2) AND ($3::timestamptz IS NULL OR created_at < $3)`
+		bucket = q.Bucket
+	)
+	if bucket == "" {
+		bucket = constant.StatsBucketDefault
+	}
+	if err = s.db.QueryRowContext(ctx, `SELECT count(*), count(DISTINCT nullif(ip_hash, ''))`+where, short, from, to).
+		Scan(&stats.Total, &stats.Unique); err != nil {
+		return
+	}
+	if err = s.db.SelectContext(ctx, &stats.Series, `SELECT date_trunc($4, created_at AT TIME ZONE 'UTC') AS time, count(*) AS clicks`+
+		where+` GROUP BY 1 ORDER BY 1`, short, from, to, bucket); err != nil {
+		return
+	}
+	for i := range stats.Series {
+		stats.Series[i].Time = stats.Series[i].Time.UTC()
+	}
+	if stats.TopReferrers, err = s.top(ctx, "referrer", where, short, from, to); err != nil {
+		return
+	}
+	stats.TopUserAgents, err = s.top(ctx, "user_agent", where, short, from, to)
+	if stats.Series == nil {
+		stats.Series = []domain.StatsPoint{}
+	}
+	return
+}
+
+func (s *DBClickStorage) top(ctx context.Context, column, where, short string, from, to sql.NullTime) (out []domain.StatsTop, err error) {
+	out = []domain.StatsTop{}
+	err = s.db.SelectContext(ctx, &out, `SELECT `+column+` AS value, count(*) AS clicks`+where+
+		` AND coalesce(`+column+`, '') <> '' GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $4`, short, from, to, constant.StatsTopSize)
+	return
+}
+
+// statsAccumulator builds domain.Stats from the click stream for storages
+// without query support
+type statsAccumulator struct {
+	short      string
+	q          domain.StatsQuery
+	total      int64
+	visitors   map[string]struct{}
+	series     map[time.Time]int64
+	referrers  map[string]int64
+	userAgents map[string]int64
+}
+
+func newStatsAccumulator(short string, q domain.StatsQuery) *statsAccumulator {
+	return &statsAccumulator{
+		short:      short,
+		q:          q,
+		visitors:   make(map[string]struct{}),
+		series:     make(map[time.Time]int64),
+		referrers:  make(map[string]int64),
+		userAgents: make(map[string]int64),
+	}
+}
+
+func (a *statsAccumulator) add(c domain.Click) {
+	if c.Short != a.short ||
+		(!a.q.From.IsZero() && c.Time.Before(a.q.From)) ||
+		(!a.q.To.IsZero() && !c.Time.Before(a.q.To)) {
+		return
+	}
+	a.total++
+	if c.IPHash != "" {
+		a.visitors[c.IPHash] = struct{}{}
+	}
+	a.series[bucketStart(c.Time, a.q.Bucket)]++
+	if c.Referrer != "" {
+		a.referrers[c.Referrer]++
+	}
+	if c.UserAgent != "" {
+		a.userAgents[c.UserAgent]++
+	}
+}
+
+func (a *statsAccumulator) result() domain.Stats {
+	stats := domain.Stats{
+		Total:         a.total,
+		Unique:        int64(len(a.visitors)),
+		Series:        make([]domain.StatsPoint, 0, len(a.series)),
+		TopReferrers:  topOf(a.referrers),
+		TopUserAgents: topOf(a.userAgents),
+	}
+	for t, n := range a.series {
+		stats.Series = append(stats.Series, domain.StatsPoint{Time: t, Clicks: n})
+	}
+	sort.Slice(stats.Series, func(i, j int) bool {
+		return stats.Series[i].Time.Before(stats.Series[j].Time)
+	})
+	return stats
+}
+
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	if bucket == constant.StatsBucketHour {
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func topOf(m map[string]int64) []domain.StatsTop {
+	out := make([]domain.StatsTop, 0, len(m))
+	for v, n := range m {
+		out = append(out, domain.StatsTop{Value: v, Clicks: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Clicks != out[j].Clicks {
+			return out[i].Clicks > out[j].Clicks
+		}
+		return out[i].Value < out[j].Value
+	})
+	if len(out) > constant.StatsTopSize {
+		out = out[:constant.StatsTopSize]
+	}
+	return out
+}
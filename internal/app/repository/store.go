@@ -1,10 +1,62 @@
 package repository
 
-import "github.com/MrSwed/go-musthave-shortener/internal/app/config"
+import (
+	"sort"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+)
 
 type storeItem struct {
-	uuid string
-	url  string
+	uuid      string
+	url       string
+	userID    string
+	isDeleted bool
+	expiresAt time.Time
+}
+
+func (i storeItem) isExpired(now time.Time) bool {
+	return !i.expiresAt.IsZero() && !i.expiresAt.After(now)
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
 }
 
 type Store map[config.ShortKey]storeItem
+
+// CanonicalURLs brings the urls of the items to the form of canonical, so the urls stored before
+// are found by the new input. The url canonical fails on, or the one its canonical form
+// is stored by the other item, is kept as is, so the url is stored once. Changed is the count of the urls changed
+func (s Store) CanonicalURLs(canonical func(string) (string, error)) (changed int) {
+	urls := make(map[string]struct{}, len(s))
+	shorts := make([]config.ShortKey, 0, len(s))
+	for sk, item := range s {
+		if !item.isDeleted {
+			urls[item.url] = struct{}{}
+		}
+		shorts = append(shorts, sk)
+	}
+	sort.Slice(shorts, func(i, j int) bool { return shorts[i] < shorts[j] })
+	for _, sk := range shorts {
+		item := s[sk]
+		c, err := canonical(item.url)
+		if err != nil || c == item.url {
+			continue
+		}
+		if _, taken := urls[c]; taken && !item.isDeleted {
+			continue
+		}
+		if !item.isDeleted {
+			delete(urls, item.url)
+			urls[c] = struct{}{}
+		}
+		item.url = c
+		s[sk] = item
+		changed++
+	}
+	return
+}
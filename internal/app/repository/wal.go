@@ -0,0 +1,335 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/metrics"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/worker"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	walOpPut    = "put"
+	walOpDelete = "delete"
+	walOpPurge  = "purge"
+)
+
+// WALRecord is the change of the one short url: the whole item for put,
+// the short and its user for delete, the short for purge
+type WALRecord struct {
+	Op string `json:"op"`
+	FileStorageItem
+}
+
+// walLine is the line of the log: the Record, or the Data of the record encrypted with the key KeyID.
+// CRC is the crc32 (IEEE) of the Record or Data bytes, like the one of the storage file records.
+// The lines written before the checksums have no crc and the record fields at the top level
+type walLine struct {
+	CRC    *uint32         `json:"crc,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+	KeyID  string          `json:"kid,omitempty"`
+	Data   []byte          `json:"data,omitempty"`
+}
+
+// WAL appends the storage changes as json lines to the log replayed over the storage file.
+// The file is opened on the first append. The sync policy is one of constant.WALSync*:
+// always syncs every append, interval syncs every WALSyncPeriod seconds, never leaves it to the os.
+// With the keys, the records are encrypted with the active key
+type WAL struct {
+	fileName string
+	policy   string
+	keys     *keyring.Keyring
+	file     *os.File
+	dirty    bool
+	m        sync.Mutex
+	log      logrus.FieldLogger
+	syncer   *worker.Periodic
+}
+
+func NewWAL(fileName, policy string, keys *keyring.Keyring, log logrus.FieldLogger) *WAL {
+	w := &WAL{
+		fileName: fileName,
+		policy:   policy,
+		keys:     keys,
+		log:      log,
+	}
+	if policy == constant.WALSyncInterval {
+		w.syncer = worker.NewPeriodic(constant.WALSyncPeriod*time.Second, 0, w.syncPeriodic)
+	}
+	return w
+}
+
+func (w *WAL) rotatedName() string {
+	return w.fileName + constant.WALRotatedSuffix
+}
+
+func (w *WAL) Append(records ...WALRecord) (err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.file == nil {
+		if w.file, err = os.OpenFile(w.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			w.file = nil
+			return
+		}
+	}
+	// the records are written at once, so the torn write is the tail only
+	var buf []byte
+	for _, r := range records {
+		var (
+			line    []byte
+			l       walLine
+			payload []byte
+		)
+		if l.Record, err = json.Marshal(r); err != nil {
+			return
+		}
+		payload = l.Record
+		if w.keys != nil {
+			if l.KeyID, l.Data, err = w.keys.Seal(l.Record); err != nil {
+				return
+			}
+			l.Record, payload = nil, l.Data
+		}
+		crc := crc32.ChecksumIEEE(payload)
+		l.CRC = &crc
+		if line, err = json.Marshal(l); err != nil {
+			return
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err = w.file.Write(buf); err != nil {
+		return
+	}
+	if w.policy == constant.WALSyncAlways {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return
+}
+
+func (w *WAL) sync() (err error) {
+	if w.file != nil && w.dirty {
+		if err = w.file.Sync(); err == nil {
+			w.dirty = false
+		}
+	}
+	return
+}
+
+func (w *WAL) closeFile() (err error) {
+	if w.file == nil {
+		return
+	}
+	err = errors.Join(w.sync(), w.file.Close())
+	w.file = nil
+	return
+}
+
+// rotate moves the log aside for the compaction, the next append starts the new one.
+// The log rotated before and not removed yet gets the current one appended
+func (w *WAL) rotate() (err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err = w.closeFile(); err != nil {
+		return
+	}
+	if _, err = os.Stat(w.rotatedName()); errors.Is(err, os.ErrNotExist) {
+		if err = os.Rename(w.fileName, w.rotatedName()); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	} else if err != nil {
+		return
+	}
+	var current []byte
+	if current, err = os.ReadFile(w.fileName); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	var rotated *os.File
+	if rotated, err = os.OpenFile(w.rotatedName(), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	if _, err = rotated.Write(current); err == nil {
+		err = rotated.Sync()
+	}
+	if err = errors.Join(err, rotated.Close()); err != nil {
+		return
+	}
+	return os.Remove(w.fileName)
+}
+
+// removeRotated drops the rotated log, its records are in the saved storage file
+func (w *WAL) removeRotated() (err error) {
+	if err = os.Remove(w.rotatedName()); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+func (w *WAL) syncPeriodic(context.Context) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err := w.sync(); err != nil {
+		w.log.WithError(err).Error("Storage log sync")
+	}
+}
+
+// Close stops the sync and closes the log synced
+func (w *WAL) Close() error {
+	if w.syncer != nil {
+		// with no deadline the close does not fail
+		_ = w.syncer.Close(context.Background())
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.closeFile()
+}
+
+// walRawLine is the not empty line of the log at the offset, not terminated is the line
+// of the append cut in the middle
+type walRawLine struct {
+	offset     int64
+	no         int
+	raw        []byte
+	terminated bool
+}
+
+// readWALLines returns the not empty lines of the log, no file is no lines
+func readWALLines(fileName string) (lines []walRawLine, err error) {
+	var file *os.File
+	if file, err = os.Open(fileName); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	var (
+		reader = bufio.NewReader(file)
+		offset int64
+		no     int
+	)
+	for {
+		raw, errR := reader.ReadBytes('\n')
+		if len(raw) > 0 {
+			no++
+			if line := bytes.TrimSpace(raw); len(line) > 0 {
+				lines = append(lines, walRawLine{offset: offset, no: no, raw: line, terminated: raw[len(raw)-1] == '\n'})
+			}
+			offset += int64(len(raw))
+		}
+		if errors.Is(errR, io.EOF) {
+			break
+		} else if errR != nil {
+			return nil, errors.Join(errR, file.Close())
+		}
+	}
+	return lines, file.Close()
+}
+
+// decodeWALLine returns the record of the line, the line of the key not in the keys
+// is the keyring.ErrUnknownKey
+func decodeWALLine(raw []byte, keys *keyring.Keyring) (r WALRecord, err error) {
+	var line walLine
+	if err = json.Unmarshal(raw, &line); err != nil {
+		return
+	}
+	record := line.Record
+	switch {
+	case line.CRC != nil:
+		payload := line.Record
+		if line.KeyID != "" {
+			payload = line.Data
+		}
+		if crc := crc32.ChecksumIEEE(payload); crc != *line.CRC {
+			err = fmt.Errorf("checksum %08x, expected %08x", crc, *line.CRC)
+			return
+		}
+	case line.KeyID == "":
+		record = raw
+	}
+	if line.KeyID != "" {
+		if record, err = keys.Open(line.KeyID, line.Data); err != nil {
+			return
+		}
+	}
+	err = json.Unmarshal(record, &r)
+	if err == nil && (r.ShortURL == "" || (r.Op != walOpPut && r.Op != walOpDelete && r.Op != walOpPurge)) {
+		err = errors.New("no short url or unknown op")
+	}
+	return
+}
+
+// replayWAL applies the log records over data. The broken last line, left by a crash
+// in the middle of the write, is cut off, so the next records are appended after the valid ones.
+// The damaged line before the last one fails the replay, or with recover set, it is skipped
+// and written to the quarantine. The record of the key not in the keys fails the replay
+func replayWAL(fileName string, data Store, keys *keyring.Keyring, recover bool, q *quarantine, log logrus.FieldLogger) (err error) {
+	var lines []walRawLine
+	if lines, err = readWALLines(fileName); err != nil {
+		return
+	}
+	var count, damaged int
+	for n, line := range lines {
+		r, errD := decodeWALLine(line.raw, keys)
+		if errors.Is(errD, keyring.ErrUnknownKey) {
+			return fmt.Errorf("%s: line %d: %w", fileName, line.no, errD)
+		}
+		if errD != nil {
+			// only the torn last line is cut off, the complete damaged one is as any other
+			if n == len(lines)-1 && !line.terminated {
+				log.WithError(errD).WithFields(logrus.Fields{"file": fileName, "offset": line.offset}).
+					Warn("Storage log is broken, the tail is cut off")
+				return os.Truncate(fileName, line.offset)
+			}
+			recErr := &RecordError{Line: line.no, Raw: line.raw, Err: errD}
+			if !recover {
+				return fmt.Errorf("%s: %w", fileName, recErr)
+			}
+			damaged++
+			metrics.StorageDamagedRecords.Inc()
+			log.WithError(errD).WithFields(logrus.Fields{"file": fileName, "line": line.no}).
+				Warn("Damaged storage log record is skipped")
+			if err = q.write(fileName, recErr); err != nil {
+				return
+			}
+			continue
+		}
+		count++
+		sk := config.ShortKey(r.ShortURL)
+		switch r.Op {
+		case walOpPut:
+			data[sk] = storeItem{
+				uuid:      r.UUID,
+				url:       r.OriginalURL,
+				userID:    r.UserID,
+				isDeleted: r.IsDeleted,
+				expiresAt: timeOrZero(r.ExpiresAt),
+			}
+		case walOpDelete:
+			if item, ok := data[sk]; ok && item.userID == r.UserID {
+				item.isDeleted = true
+				data[sk] = item
+			}
+		case walOpPurge:
+			delete(data, sk)
+		}
+	}
+	log.WithFields(logrus.Fields{"file": fileName, "count": count, "damaged": damaged}).Debug("Storage log replayed")
+	return
+}
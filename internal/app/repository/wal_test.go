@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/keyring"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLog() logrus.FieldLogger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func walPut(t *testing.T, short, url string) string {
+	t.Helper()
+	line, err := json.Marshal(WALRecord{Op: walOpPut, FileStorageItem: FileStorageItem{ShortURL: short, OriginalURL: url}})
+	require.NoError(t, err)
+	return string(line) + "\n"
+}
+
+// walLines returns the lines the log writes for the records
+func walLines(t *testing.T, keys *keyring.Keyring, records ...WALRecord) []string {
+	t.Helper()
+	fileName := t.TempDir() + "/storage.json" + constant.WALFileSuffix
+	w := NewWAL(fileName, constant.WALSyncNever, keys, testLog())
+	require.NoError(t, w.Append(records...))
+	require.NoError(t, w.Close())
+	wal, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(string(wal), "\n")
+	return lines[:len(lines)-1]
+}
+
+func TestReplayWAL(t *testing.T) {
+	const damagedLine = `{"op":"put","short_url":` + "\n"
+
+	// restore reads the storage of the log lines, with no storage file
+	restore := func(t *testing.T, recover bool, lines ...string) (storageFile string, data Store, err error) {
+		storageFile = t.TempDir() + "/storage.json"
+		var wal []byte
+		for _, l := range lines {
+			wal = append(wal, l...)
+		}
+		require.NoError(t, os.WriteFile(storageFile+constant.WALFileSuffix, wal, 0644))
+		f := NewFileStorage(storageFile, testLog())
+		f.recover = recover
+		data, err = f.Restore()
+		return
+	}
+
+	t.Run("torn tail is cut off", func(t *testing.T) {
+		a, b := walPut(t, "a", "https://a.example/"), walPut(t, "b", "https://b.example/")
+		storageFile, data, err := restore(t, false, a, b, `{"op":"put","short_url":"torn`)
+		require.NoError(t, err)
+		assert.Len(t, data, 2)
+		wal, err := os.ReadFile(storageFile + constant.WALFileSuffix)
+		require.NoError(t, err)
+		assert.Equal(t, a+b, string(wal))
+	})
+
+	t.Run("complete damaged last line fails the restore", func(t *testing.T) {
+		a := walPut(t, "a", "https://a.example/")
+		storageFile, _, err := restore(t, false, a, damagedLine)
+		assert.ErrorIs(t, err, myErr.ErrDamagedRecord)
+		wal, err := os.ReadFile(storageFile + constant.WALFileSuffix)
+		require.NoError(t, err)
+		assert.Equal(t, a+damagedLine, string(wal), "the log is kept as is")
+	})
+
+	t.Run("damaged line in the middle fails the restore", func(t *testing.T) {
+		a, b := walPut(t, "a", "https://a.example/"), walPut(t, "b", "https://b.example/")
+		storageFile, _, err := restore(t, false, a, damagedLine, b)
+		assert.ErrorIs(t, err, myErr.ErrDamagedRecord)
+		wal, err := os.ReadFile(storageFile + constant.WALFileSuffix)
+		require.NoError(t, err)
+		assert.Equal(t, a+damagedLine+b, string(wal), "the log is kept as is")
+	})
+
+	t.Run("damaged line in the middle is quarantined with recover", func(t *testing.T) {
+		storageFile, data, err := restore(t, true,
+			walPut(t, "a", "https://a.example/"), damagedLine, walPut(t, "b", "https://b.example/"))
+		require.NoError(t, err)
+		assert.Equal(t, "https://b.example/", data[config.ShortKey("b")].url)
+		assert.Len(t, data, 2)
+		q, err := os.ReadFile(storageFile + constant.StorageQuarantineSuffix)
+		require.NoError(t, err)
+		var rec quarantineRecord
+		require.NoError(t, json.Unmarshal(q, &rec))
+		assert.Equal(t, 2, rec.Line)
+		assert.Equal(t, storageFile+constant.WALFileSuffix, rec.File)
+	})
+
+	t.Run("bit flip is caught by the checksum", func(t *testing.T) {
+		keys, err := keyring.Parse("k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+		require.NoError(t, err)
+		for name, keys := range map[string]*keyring.Keyring{"plain": nil, "encrypted": keys} {
+			// the flipped last line is complete, so it is not cut off as torn
+			for where, n := range map[string]int{"middle": 1, "last": 2} {
+				t.Run(name+" "+where, func(t *testing.T) {
+					lines := walLines(t, keys,
+						WALRecord{Op: walOpPut, FileStorageItem: FileStorageItem{ShortURL: "a", OriginalURL: "https://a.example/"}},
+						WALRecord{Op: walOpPut, FileStorageItem: FileStorageItem{ShortURL: "b", OriginalURL: "https://b.example/"}},
+						WALRecord{Op: walOpPut, FileStorageItem: FileStorageItem{ShortURL: "c", OriginalURL: "https://c.example/"}},
+					)
+					// the changed last digit of the crc leaves the line the valid json
+					flipped := []byte(lines[n])
+					i := strings.Index(lines[n], `"crc":`) + len(`"crc":`)
+					for i+1 < len(flipped) && flipped[i+1] >= '0' && flipped[i+1] <= '9' {
+						i++
+					}
+					flipped[i] = '0' + (flipped[i]-'0'+1)%10
+					lines[n] = string(flipped)
+
+					storageFile := t.TempDir() + "/storage.json"
+					require.NoError(t, os.WriteFile(storageFile+constant.WALFileSuffix, []byte(strings.Join(lines, "")), 0644))
+					f := NewFileStorage(storageFile, testLog())
+					f.keys = keys
+					_, err := f.Restore()
+					assert.ErrorIs(t, err, myErr.ErrDamagedRecord)
+					wal, err := os.ReadFile(storageFile + constant.WALFileSuffix)
+					require.NoError(t, err)
+					assert.Equal(t, strings.Join(lines, ""), string(wal), "the log is kept as is")
+
+					f.recover = true
+					data, err := f.Restore()
+					require.NoError(t, err)
+					assert.Len(t, data, 2)
+					assert.NotContains(t, data, config.ShortKey([]string{"a", "b", "c"}[n]))
+					_, err = os.Stat(storageFile + constant.StorageQuarantineSuffix)
+					assert.NoError(t, err)
+				})
+			}
+		}
+	})
+}
+
+func TestMemStorageRepository_PurgeExpired(t *testing.T) {
+	storageFile := t.TempDir() + "/storage.json"
+	w := NewWAL(storageFile+constant.WALFileSuffix, constant.WALSyncNever, nil, testLog())
+	r := NewMemRepository(shortcode.Default(), testLog())
+	r.wal = w
+
+	expired := time.Now().Add(-time.Minute)
+	_, err := r.NewShort(context.Background(), domain.CreateURL{URL: "https://expired.example/", ExpiresAt: &expired})
+	require.NoError(t, err)
+	live, err := r.NewShort(context.Background(), domain.CreateURL{URL: "https://live.example/"})
+	require.NoError(t, err)
+
+	n, err := r.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	require.NoError(t, w.Close())
+
+	// the replay does not bring the purged item back
+	data, err := NewFileStorage(storageFile, testLog()).Restore()
+	require.NoError(t, err)
+	assert.Len(t, data, 1)
+	assert.Contains(t, data, config.ShortKey(live))
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// batcher fans in items from many producers into one bounded queue and
+// passes them to flush in batches: every interval or as soon as batchSize items are pending.
+// The flush is cancelled after the timeout
+type batcher[T any] struct {
+	name      string
+	input     chan T
+	done      chan struct{}
+	m         sync.RWMutex
+	closed    bool
+	batchSize int
+	interval  time.Duration
+	timeout   time.Duration
+	flush     func(ctx context.Context, items []T) error
+	log       logrus.FieldLogger
+}
+
+func newBatcher[T any](name string, queueSize, batchSize int, interval, timeout time.Duration,
+	flush func(ctx context.Context, items []T) error, log logrus.FieldLogger) *batcher[T] {
+	b := &batcher[T]{
+		name:      name,
+		input:     make(chan T, queueSize),
+		done:      make(chan struct{}),
+		batchSize: batchSize,
+		interval:  interval,
+		timeout:   timeout,
+		flush:     flush,
+		log:       log,
+	}
+	go b.run()
+	return b
+}
+
+// add puts items to the queue, waiting for a free place
+func (b *batcher[T]) add(ctx context.Context, items ...T) error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if b.closed {
+		return myErr.ErrShutdown
+	}
+	for _, item := range items {
+		select {
+		case b.input <- item:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// tryAdd puts item to the queue without waiting, false if the queue is full or closed
+func (b *batcher[T]) tryAdd(item T) bool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if b.closed {
+		return false
+	}
+	select {
+	case b.input <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// check reports the batcher is closed or its queue is full
+func (b *batcher[T]) check() error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if b.closed {
+		return myErr.ErrShutdown
+	}
+	if len(b.input) == cap(b.input) {
+		return fmt.Errorf("%s: queue is full", b.name)
+	}
+	return nil
+}
+
+// close stops accepting new items and waits until the queue is flushed
+func (b *batcher[T]) close(ctx context.Context) error {
+	b.m.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.input)
+	}
+	b.m.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher[T]) run() {
+	defer close(b.done)
+	var (
+		buf    []T
+		ticker = time.NewTicker(b.interval)
+	)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		defer cancel()
+		if err := b.flush(ctx, buf); err != nil {
+			b.log.WithError(err).WithField("count", len(buf)).Error(b.name)
+		}
+		buf = nil
+	}
+
+	for {
+		select {
+		case item, ok := <-b.input:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(buf, item)
+			if len(buf) >= b.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
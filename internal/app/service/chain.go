@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+)
+
+// ownPrefixes are the canonical beginnings of the own short links, without scheme
+func (s ShorterService) ownPrefixes() (prefixes []string) {
+	for _, own := range []string{s.c.BaseURL, s.c.ServerAddress} {
+		if strings.HasPrefix(own, ":") {
+			continue
+		}
+		if u, err := canonicalURL(s.c.Scheme+own, false); err == nil {
+			prefixes = append(prefixes, strings.TrimSuffix(withoutScheme(u), "/")+"/")
+		}
+	}
+	return
+}
+
+func withoutScheme(u string) string {
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		return rest
+	}
+	return u
+}
+
+// ownShort returns the short of the url on the own host,
+// empty one if the own url is not a short link
+func ownShort(u string, prefixes []string) (short string, own bool) {
+	u = withoutScheme(u)
+	for _, prefix := range prefixes {
+		if rest, ok := strings.CutPrefix(u, prefix); ok {
+			if i := strings.IndexAny(rest, "?#"); i >= 0 {
+				rest = rest[:i]
+			}
+			if strings.Contains(rest, "/") {
+				rest = ""
+			}
+			return rest, true
+		}
+	}
+	return
+}
+
+// resolveOwnURL follows the own short links to the final url, so no chains are stored.
+// Links are followed up to config MaxChainDepth, a cycle or a link to the alias being created
+// returns myErr.ErrRedirectLoop
+func (s ShorterService) resolveOwnURL(ctx context.Context, target, alias string) (string, error) {
+	prefixes := s.ownPrefixes()
+	seen := make(map[string]struct{})
+	if alias != "" {
+		seen[alias] = struct{}{}
+	}
+	for depth := 0; ; depth++ {
+		short, own := ownShort(target, prefixes)
+		if !own {
+			return target, nil
+		}
+		if short == "" {
+			return "", invalidURL("%s is the own url, not a short link", target)
+		}
+		if _, ok := seen[short]; ok {
+			return "", fmt.Errorf("%w: %w: %s", myErr.ErrInvalidURL, myErr.ErrRedirectLoop, short)
+		}
+		if depth >= s.c.MaxChainDepth {
+			return "", invalidURL("own short links chain is deeper than %d", s.c.MaxChainDepth)
+		}
+		seen[short] = struct{}{}
+		next, err := s.r.GetFromShort(ctx, short)
+		if errors.Is(err, myErr.ErrNotExist) || errors.Is(err, myErr.ErrIsDeleted) || errors.Is(err, myErr.ErrExpired) {
+			return "", invalidURL("own short link %s %v", short, err)
+		} else if err != nil {
+			return "", err
+		}
+		target = next
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/worker"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
+)
+
+const (
+	BlockReasonDomain  = "domain_blocked"
+	BlockReasonPattern = "pattern_blocked"
+
+	blocklistPatternPrefix = "re:"
+)
+
+// URLChecker tells whether the url may be shortened and followed.
+// A refused url returns *myErr.BlockedError
+type URLChecker interface {
+	Check(ctx context.Context, url string) error
+}
+
+// URLCheckers consults all the checkers in order, the first refusal wins
+type URLCheckers []URLChecker
+
+func (cs URLCheckers) Check(ctx context.Context, url string) error {
+	for _, c := range cs {
+		if err := c.Check(ctx, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BlocklistChecker refuses urls by the local file of rules, one per line:
+// a domain, blocked with all its subdomains, or "re:" and a regular expression
+// matched against the whole url. Empty lines and lines starting with "#" are skipped.
+// The file is reloaded every BlocklistReloadInterval seconds when modified
+type BlocklistChecker struct {
+	fileName string
+	m        sync.RWMutex
+	modTime  time.Time
+	domains  map[string]struct{}
+	patterns []*regexp.Regexp
+	log      logrus.FieldLogger
+	w        *worker.Periodic
+}
+
+func NewBlocklistChecker(fileName string, log logrus.FieldLogger) (*BlocklistChecker, error) {
+	b := &BlocklistChecker{
+		fileName: fileName,
+		log:      log,
+		domains:  make(map[string]struct{}),
+	}
+	if _, err := b.Reload(); err != nil {
+		return nil, err
+	}
+	b.w = worker.NewPeriodic(constant.BlocklistReloadInterval*time.Second, 0, b.reloadPeriodic)
+	return b, nil
+}
+
+func (b *BlocklistChecker) Check(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	b.m.RLock()
+	defer b.m.RUnlock()
+	for host := strings.ToLower(u.Hostname()); host != ""; {
+		if _, ok := b.domains[host]; ok {
+			return &myErr.BlockedError{Reason: BlockReasonDomain, Rule: host}
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	for _, re := range b.patterns {
+		if re.MatchString(raw) {
+			return &myErr.BlockedError{Reason: BlockReasonPattern, Rule: re.String()}
+		}
+	}
+	return nil
+}
+
+// Reload reads the file if it was modified since the last load.
+// On error the previous rules are kept
+func (b *BlocklistChecker) Reload() (reloaded bool, err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(b.fileName); err != nil {
+		return
+	}
+	b.m.RLock()
+	modTime := b.modTime
+	b.m.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+
+	var file *os.File
+	if file, err = os.Open(b.fileName); err != nil {
+		return
+	}
+	defer func() {
+		if errC := file.Close(); err == nil {
+			err = errC
+		}
+	}()
+	var (
+		domains  = make(map[string]struct{})
+		patterns []*regexp.Regexp
+		scanner  = bufio.NewScanner(file)
+		line     int
+	)
+	for scanner.Scan() {
+		line++
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		if expr, ok := strings.CutPrefix(rule, blocklistPatternPrefix); ok {
+			var re *regexp.Regexp
+			if re, err = regexp.Compile(expr); err != nil {
+				err = fmt.Errorf("blocklist %s line %d: %w", b.fileName, line, err)
+				return
+			}
+			patterns = append(patterns, re)
+			continue
+		}
+		domain := strings.Trim(strings.TrimPrefix(strings.ToLower(rule), "*."), ".")
+		if domain, err = idna.Lookup.ToASCII(domain); err != nil {
+			err = fmt.Errorf("blocklist %s line %d: %w", b.fileName, line, err)
+			return
+		}
+		domains[domain] = struct{}{}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	b.m.Lock()
+	b.modTime = info.ModTime()
+	b.domains = domains
+	b.patterns = patterns
+	b.m.Unlock()
+	reloaded = true
+	return
+}
+
+// Close stops watching the file
+func (b *BlocklistChecker) Close(ctx context.Context) error {
+	return b.w.Close(ctx)
+}
+
+func (b *BlocklistChecker) reloadPeriodic(context.Context) {
+	if reloaded, err := b.Reload(); err != nil {
+		b.log.WithError(err).Error("Blocklist reload")
+	} else if reloaded {
+		b.log.WithField("file", b.fileName).Info("Blocklist reloaded")
+	}
+}
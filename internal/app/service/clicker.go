@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Clicker interface {
+	Click(short, referrer, userAgent, ip string)
+	Check(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// ClickerService queues redirect events and writes them to the click storage
+// in batches. The redirect is never blocked: events are dropped when the queue is full
+type ClickerService struct {
+	b *batcher[domain.Click]
+	c *config.Config
+}
+
+func NewClickerService(r repository.Repository, c *config.Config, log logrus.FieldLogger) *ClickerService {
+	return &ClickerService{
+		b: newBatcher("Save clicks", constant.ClickQueueSize, constant.ClickBatchSize,
+			constant.ClickFlushInterval*time.Second, c.OperationTimeoutDuration(), r.SaveClicks, log),
+		c: c,
+	}
+}
+
+func (s *ClickerService) Click(short, referrer, userAgent, ip string) {
+	s.b.tryAdd(domain.Click{
+		Time:      time.Now(),
+		Short:     short,
+		Referrer:  referrer,
+		UserAgent: userAgent,
+		IPHash:    s.hashIP(ip),
+	})
+}
+
+// Check reports the queue is not accepting events
+func (s *ClickerService) Check(ctx context.Context) error {
+	return s.b.check()
+}
+
+// Close stops accepting new events and waits until the queue is flushed
+func (s *ClickerService) Close(ctx context.Context) error {
+	return s.b.close(ctx)
+}
+
+func (s *ClickerService) hashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	h := hmac.New(sha256.New, []byte(s.c.SecretKey))
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/worker"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Compactor interface {
+	Check(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// CompactorService merges the storage log into the storage file every interval.
+// Zero interval is no periodic compaction, the storage is saved on shutdown only.
+// The compaction is cancelled after the timeout
+type CompactorService struct {
+	r   repository.Repository
+	log logrus.FieldLogger
+	w   *worker.Periodic
+}
+
+func NewCompactorService(r repository.Repository, interval, timeout time.Duration, log logrus.FieldLogger) *CompactorService {
+	cs := &CompactorService{
+		r:   r,
+		log: log,
+	}
+	cs.w = worker.NewPeriodic(interval, timeout, cs.compact)
+	return cs
+}
+
+// Check reports the compactor is stopped
+func (cs *CompactorService) Check(ctx context.Context) error {
+	if cs.w.Stopped() {
+		return myErr.ErrShutdown
+	}
+	return nil
+}
+
+// Close stops the compactor and waits for the running compaction
+func (cs *CompactorService) Close(ctx context.Context) error {
+	return cs.w.Close(ctx)
+}
+
+func (cs *CompactorService) compact(ctx context.Context) {
+	start := time.Now()
+	if err := cs.r.Compact(ctx, cs.r.GetAll); err != nil {
+		cs.log.WithError(err).Error("Storage compact")
+	} else {
+		cs.log.WithField("duration", time.Since(start)).Debug("Storage compacted")
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/helper"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Deleter interface {
+	DeleteUserURLs(ctx context.Context, shorts []string) error
+	Check(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// DeleterService collects delete requests of all users into one queue
+// and marks them deleted in bulk: every DeleteFlushInterval seconds or as soon
+// as DeleteBatchSize items are pending
+type DeleterService struct {
+	b *batcher[domain.DeleteURLItem]
+}
+
+func NewDeleterService(r repository.Repository, timeout time.Duration, log logrus.FieldLogger) *DeleterService {
+	return &DeleterService{
+		b: newBatcher("Delete urls", constant.DeleteQueueSize, constant.DeleteBatchSize,
+			constant.DeleteFlushInterval*time.Second, timeout, r.DeleteURLs, log),
+	}
+}
+
+func (d *DeleterService) DeleteUserURLs(ctx context.Context, shorts []string) error {
+	userID := helper.UserIDFromContext(ctx)
+	items := make([]domain.DeleteURLItem, 0, len(shorts))
+	for _, short := range shorts {
+		items = append(items, domain.DeleteURLItem{UserID: userID, Short: short})
+	}
+	return d.b.add(ctx, items...)
+}
+
+// Check reports the queue is not accepting requests
+func (d *DeleterService) Check(ctx context.Context) error {
+	return d.b.check()
+}
+
+// Close stops accepting new requests and waits until the queue is flushed
+func (d *DeleterService) Close(ctx context.Context) error {
+	return d.b.close(ctx)
+}
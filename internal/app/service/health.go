@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+)
+
+type Health interface {
+	Ready(ctx context.Context) (domain.Readiness, bool)
+	AddCheck(name string, check func(ctx context.Context) error)
+	ShuttingDown()
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// HealthService runs the named dependency checks in parallel for the readiness,
+// every one limited by HealthCheckTimeout seconds. Once shutting down, it is not ready
+type HealthService struct {
+	m            sync.RWMutex
+	checks       []healthCheck
+	shuttingDown atomic.Bool
+}
+
+func NewHealthService() *HealthService {
+	return &HealthService{}
+}
+
+func (h *HealthService) AddCheck(name string, check func(ctx context.Context) error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// ShuttingDown marks the service not ready, so the balancer stops sending requests
+func (h *HealthService) ShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+func (h *HealthService) Ready(ctx context.Context) (r domain.Readiness, ready bool) {
+	h.m.RLock()
+	checks := h.checks
+	h.m.RUnlock()
+
+	r.Checks = make([]domain.CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, constant.HealthCheckTimeout*time.Second)
+			defer cancel()
+			start := time.Now()
+			err := c.check(ctx)
+			r.Checks[i] = domain.CheckResult{
+				Name:      c.name,
+				Status:    domain.StatusOK,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				r.Checks[i].Status = domain.StatusFail
+				r.Checks[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	ready = true
+	for _, c := range r.Checks {
+		ready = ready && c.Status == domain.StatusOK
+	}
+	if h.shuttingDown.Load() {
+		ready = false
+		r.Error = myErr.ErrShutdown.Error()
+	}
+	r.Status = domain.StatusOK
+	if !ready {
+		r.Status = domain.StatusFail
+	}
+	return
+}
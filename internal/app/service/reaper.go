@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/worker"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Reaper interface {
+	Check(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// ReaperService purges expired links every ReaperInterval seconds, the purge is cancelled after the timeout
+type ReaperService struct {
+	r   repository.Repository
+	log logrus.FieldLogger
+	w   *worker.Periodic
+}
+
+func NewReaperService(r repository.Repository, timeout time.Duration, log logrus.FieldLogger) *ReaperService {
+	rp := &ReaperService{
+		r:   r,
+		log: log,
+	}
+	rp.w = worker.NewPeriodic(constant.ReaperInterval*time.Second, timeout, rp.purge)
+	return rp
+}
+
+// Check reports the reaper is stopped
+func (rp *ReaperService) Check(ctx context.Context) error {
+	if rp.w.Stopped() {
+		return myErr.ErrShutdown
+	}
+	return nil
+}
+
+// Close stops the reaper and waits for the running purge
+func (rp *ReaperService) Close(ctx context.Context) error {
+	return rp.w.Close(ctx)
+}
+
+func (rp *ReaperService) purge(ctx context.Context) {
+	if n, err := rp.r.PurgeExpired(ctx); err != nil {
+		rp.log.WithError(err).Error("Purge expired")
+	} else if n > 0 {
+		rp.log.WithField("count", n).Info("Purged expired")
+	}
+}
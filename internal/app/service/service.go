@@ -1,14 +1,49 @@
 package service
 
 import (
+	"context"
+	"time"
+
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
+
+	"github.com/sirupsen/logrus"
 )
 
 type Service struct {
 	Shorter
+	Deleter
+	Reaper
+	Clicker
+	Statistic
+	Health
+	Compactor
 }
 
-func NewService(r repository.Repository, c *config.Config) Service {
-	return Service{Shorter: NewShorterService(r, c)}
+// NewService builds the services, checkers are consulted in order before a url is stored or followed
+// The readiness checks the storage, the storage file when set and the background workers.
+// The storage log of the memory storage is compacted every c.CompactInterval
+func NewService(r repository.Repository, c *config.Config, log logrus.FieldLogger, checkers ...URLChecker) Service {
+	var compactInterval time.Duration
+	if c.FileStoragePath != "" && c.DatabaseDSN == "" {
+		compactInterval = c.CompactIntervalDuration()
+	}
+	s := Service{
+		Shorter:   NewShorterService(r, c, checkers...),
+		Deleter:   NewDeleterService(r, c.OperationTimeoutDuration(), log),
+		Reaper:    NewReaperService(r, c.OperationTimeoutDuration(), log),
+		Clicker:   NewClickerService(r, c, log),
+		Statistic: NewStatisticService(r),
+		Health:    NewHealthService(),
+		Compactor: NewCompactorService(r, compactInterval, c.OperationTimeoutDuration(), log),
+	}
+	s.AddCheck("storage", r.Ping)
+	if c.FileStoragePath != "" {
+		s.AddCheck("file_storage", func(context.Context) error { return r.Writable() })
+	}
+	s.AddCheck("deleter", s.Deleter.Check)
+	s.AddCheck("clicker", s.Clicker.Check)
+	s.AddCheck("reaper", s.Reaper.Check)
+	s.AddCheck("compactor", s.Compactor.Check)
+	return s
 }
@@ -2,45 +2,64 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/MrSwed/go-musthave-shortener/internal/app/config"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
 	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
 	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
-
-	"github.com/go-playground/validator/v10"
 )
 
 type Shorter interface {
-	NewShort(ctx context.Context, url string) (string, error)
+	NewShort(ctx context.Context, in domain.CreateURL) (string, error)
 	GetFromShort(ctx context.Context, k string) (string, error)
 	CheckDB(ctx context.Context) error
 	GetAll(ctx context.Context) (repository.Store, error)
 	RestoreAll(repository.Store) error
 	NewShortBatch(context.Context, []domain.ShortBatchInputItem) ([]domain.ShortBatchResultItem, error)
+	NewShortBatchPartial(context.Context, []domain.ShortBatchInputItem) ([]domain.ShortBatchResultItem, error)
+	GetUserURLs(ctx context.Context) ([]domain.UserURLItem, error)
 }
 
 type ShorterService struct {
-	r repository.Repository
-	c *config.Config
+	r       repository.Repository
+	c       *config.Config
+	checker URLCheckers
 }
 
-func NewShorterService(r repository.Repository, c *config.Config) ShorterService {
-	return ShorterService{r: r, c: c}
+func NewShorterService(r repository.Repository, c *config.Config, checkers ...URLChecker) ShorterService {
+	return ShorterService{r: r, c: c, checker: checkers}
 }
 
 func (s ShorterService) fulNewShort(short string) string {
 	return s.c.Scheme + s.c.BaseURL + "/" + short
 
 }
-func (s ShorterService) NewShort(ctx context.Context, url string) (newURL string, err error) {
-	var newShort string
-	if newShort, err = s.r.GetFromURL(ctx, url); err != nil {
+
+// NewShort creates a short link for in.URL. If the url is already shortened,
+// its existing short is returned with myErr.ErrAlreadyExist even when other alias is asked.
+// The url is canonicalized before lookup, invalid one returns myErr.ErrInvalidURL,
+// the own short link is replaced by its final url,
+// refused by the checkers one returns *myErr.BlockedError
+func (s ShorterService) NewShort(ctx context.Context, in domain.CreateURL) (newURL string, err error) {
+	if err = validate.Struct(in); err != nil {
 		return
 	}
-	if newShort != "" {
-		err = myErr.ErrAlreadyExist
-	} else if newShort, err = s.r.NewShort(ctx, url); err != nil {
+	if in.URL, err = canonicalURL(in.URL, s.c.SortQuery); err != nil {
+		return
+	}
+	if in.URL, err = s.resolveOwnURL(ctx, in.URL, in.Alias); err != nil {
+		return
+	}
+	if err = s.checker.Check(ctx, in.URL); err != nil {
+		return
+	}
+	in.ExpiresAt, in.ExpiresIn = expiresAt(in.ExpiresIn, in.ExpiresAt), 0
+	// the url is checked by the storage on insert, so the concurrent requests of the url get the one short
+	var newShort string
+	if newShort, err = s.r.NewShort(ctx, in); err != nil && !errors.Is(err, myErr.ErrAlreadyExist) {
 		return
 	}
 
@@ -48,8 +67,13 @@ func (s ShorterService) NewShort(ctx context.Context, url string) (newURL string
 	return
 }
 
+// GetFromShort returns the url of the short. The url blocked after shortening
+// is returned together with *myErr.BlockedError
 func (s ShorterService) GetFromShort(ctx context.Context, k string) (v string, err error) {
-	v, err = s.r.GetFromShort(ctx, k)
+	if v, err = s.r.GetFromShort(ctx, k); err != nil {
+		return
+	}
+	err = s.checker.Check(ctx, v)
 	return
 }
 
@@ -62,15 +86,99 @@ func (s ShorterService) GetAll(ctx context.Context) (repository.Store, error) {
 	return s.r.GetAll(ctx)
 }
 
+// RestoreAll loads the data of the storage file, the urls stored before they were made canonical
+// are brought to the canonical form
 func (s ShorterService) RestoreAll(data repository.Store) error {
+	data.CanonicalURLs(func(url string) (string, error) { return canonicalURL(url, s.c.SortQuery) })
 	return s.r.RestoreAll(data)
 }
 
+func (s ShorterService) checkBatchSize(input []domain.ShortBatchInputItem) error {
+	if s.c.BatchMaxSize > 0 && len(input) > s.c.BatchMaxSize {
+		return fmt.Errorf("%w: %d items, max is %d", myErr.ErrBatchTooLarge, len(input), s.c.BatchMaxSize)
+	}
+	return nil
+}
+
+// prepareBatchItem makes the url of the item canonical and checks it, the expiry is made absolute
+func (s ShorterService) prepareBatchItem(ctx context.Context, item *domain.ShortBatchInputItem) (err error) {
+	if item.OriginalURL, err = canonicalURL(item.OriginalURL, s.c.SortQuery); err == nil {
+		item.OriginalURL, err = s.resolveOwnURL(ctx, item.OriginalURL, item.Alias)
+	}
+	if err == nil {
+		err = s.checker.Check(ctx, item.OriginalURL)
+	}
+	if err != nil {
+		return &myErr.BatchItemError{CorrelationID: item.CorrelationID, Err: err}
+	}
+	item.ExpiresAt, item.ExpiresIn = expiresAt(item.ExpiresIn, item.ExpiresAt), 0
+	return
+}
+
+// NewShortBatch creates the short links of the input, any failed item fails the batch.
+// The input over config BatchMaxSize items returns myErr.ErrBatchTooLarge
 func (s ShorterService) NewShortBatch(ctx context.Context, input []domain.ShortBatchInputItem) (out []domain.ShortBatchResultItem, err error) {
-	validate := validator.New()
+	if err = s.checkBatchSize(input); err != nil {
+		return
+	}
 	if err = validate.Struct(domain.ShortBatchInput{List: input}); err != nil {
 		return
 	}
+	for i := range input {
+		if err = s.prepareBatchItem(ctx, &input[i]); err != nil {
+			return
+		}
+	}
 
 	return s.r.NewShortBatch(ctx, input, s.c.Scheme+s.c.BaseURL+"/")
 }
+
+// NewShortBatchPartial creates the short links of the valid items, the failed item gets its Err,
+// the url stored before gets its short with myErr.ErrAlreadyExist. The result is in the input order
+func (s ShorterService) NewShortBatchPartial(ctx context.Context, input []domain.ShortBatchInputItem) (out []domain.ShortBatchResultItem, err error) {
+	if err = s.checkBatchSize(input); err != nil {
+		return
+	}
+	if err = validate.Var(input, "required,gt=0"); err != nil {
+		return
+	}
+	var (
+		valid   = make([]domain.ShortBatchInputItem, 0, len(input))
+		indexes = make([]int, 0, len(input))
+	)
+	out = make([]domain.ShortBatchResultItem, len(input))
+	for i := range input {
+		out[i].CorrelationTD = input[i].CorrelationID
+		if out[i].Err = validate.Struct(input[i]); out[i].Err == nil {
+			out[i].Err = s.prepareBatchItem(ctx, &input[i])
+		}
+		if out[i].Err == nil {
+			valid = append(valid, input[i])
+			indexes = append(indexes, i)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	var stored []domain.ShortBatchResultItem
+	if stored, err = s.r.NewShortBatchPartial(ctx, valid, s.c.Scheme+s.c.BaseURL+"/"); err != nil {
+		return nil, err
+	}
+	for n, i := range indexes {
+		out[i] = stored[n]
+	}
+	return
+}
+
+func (s ShorterService) GetUserURLs(ctx context.Context) ([]domain.UserURLItem, error) {
+	return s.r.GetUserURLs(ctx, s.c.Scheme+s.c.BaseURL+"/")
+}
+
+// expiresAt converts ttl in seconds to an absolute time
+func expiresAt(ttl int64, at *time.Time) *time.Time {
+	if ttl > 0 {
+		t := time.Now().Add(time.Duration(ttl) * time.Second)
+		return &t
+	}
+	return at
+}
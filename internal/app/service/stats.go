@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/domain"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/repository"
+)
+
+type Statistic interface {
+	GetStats(ctx context.Context, short string, q domain.StatsQuery) (domain.Stats, error)
+}
+
+type StatisticService struct {
+	r repository.Repository
+}
+
+func NewStatisticService(r repository.Repository) StatisticService {
+	return StatisticService{r: r}
+}
+
+// GetStats returns the clicks statistics of the short, the short never stored returns myErr.ErrNotExist.
+// The deleted or expired short still has its statistics
+func (s StatisticService) GetStats(ctx context.Context, short string, q domain.StatsQuery) (stats domain.Stats, err error) {
+	if err = validate.Struct(q); err != nil {
+		return
+	}
+	if _, err = s.r.GetFromShort(ctx, short); errors.Is(err, myErr.ErrIsDeleted) || errors.Is(err, myErr.ErrExpired) {
+		err = nil
+	} else if err != nil {
+		return
+	}
+	if q.Bucket == "" {
+		q.Bucket = constant.StatsBucketDefault
+	}
+	return s.r.GetStats(ctx, short, q)
+}
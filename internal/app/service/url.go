@@ -0,0 +1,80 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	myErr "github.com/MrSwed/go-musthave-shortener/internal/app/errors"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	allowedSchemes = map[string]struct{}{
+		"http":  {},
+		"https": {},
+	}
+	defaultPorts = map[string]string{
+		"http":  "80",
+		"https": "443",
+	}
+)
+
+func invalidURL(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", myErr.ErrInvalidURL, fmt.Sprintf(format, a...))
+}
+
+// canonicalURL validates raw and brings it to the one form, so equal urls are
+// stored and looked up once: lowercase scheme and host, host in punycode,
+// no default port, "/" for the empty path and, optionally, sorted query.
+// The urls of the storage file are made canonical on restore, the rows already in the db are not:
+// the url stored there before is found by its exact form only
+func canonicalURL(raw string, sortQuery bool) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", invalidURL("url is required")
+	}
+	if len(raw) > constant.URLMaxLen {
+		return "", invalidURL("url is longer than %d", constant.URLMaxLen)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", invalidURL("url can not be parsed")
+	}
+	if u.Scheme == "" {
+		return "", invalidURL("scheme is required")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := allowedSchemes[u.Scheme]; !ok {
+		return "", invalidURL("scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", invalidURL("host is required")
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", invalidURL("host %q is not valid", u.Hostname())
+		}
+	} else if ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+	u.Host = host
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if sortQuery && u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+	canonical := u.String()
+	if len(canonical) > constant.URLMaxLen {
+		return "", invalidURL("url is longer than %d", constant.URLMaxLen)
+	}
+	return canonical, nil
+}
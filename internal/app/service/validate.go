@@ -0,0 +1,34 @@
+package service
+
+import (
+	"regexp"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+	"github.com/MrSwed/go-musthave-shortener/internal/app/shortcode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var (
+	aliasRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	validate = newValidator()
+)
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	_ = v.RegisterValidation("alias", func(fl validator.FieldLevel) bool {
+		return isValidAlias(fl.Field().String())
+	})
+	return v
+}
+
+func isValidAlias(alias string) bool {
+	if len(alias) < constant.AliasMinLen || len(alias) > constant.AliasMaxLen {
+		return false
+	}
+	if shortcode.Reserved(alias) {
+		return false
+	}
+	return aliasRe.MatchString(alias)
+}
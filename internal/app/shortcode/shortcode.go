@@ -0,0 +1,231 @@
+package shortcode
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+)
+
+// CodeGenerator makes the short codes. Attempt is the count of the codes of the url
+// already taken, the generator makes the other code for the next attempt
+type CodeGenerator interface {
+	Generate(url string, attempt int) string
+	// Keyspace is the count of the different codes the generator makes
+	Keyspace() float64
+	// Poolable reports the codes do not depend on the url, so they can be made ahead
+	Poolable() bool
+}
+
+var (
+	alphabetRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	// reserved are the first segments of the own routes
+	reserved = map[string]struct{}{
+		strings.TrimPrefix(constant.PingRoute, "/"):    {},
+		strings.TrimPrefix(constant.MetricsRoute, "/"): {},
+		strings.TrimPrefix(constant.WarningRoute, "/"): {},
+		strings.TrimPrefix(constant.HealthzRoute, "/"): {},
+		strings.TrimPrefix(constant.ReadyzRoute, "/"):  {},
+		strings.TrimPrefix(constant.APIRoute, "/"):     {},
+	}
+)
+
+// Reserved reports the code is the own route, in any case
+func Reserved(code string) bool {
+	_, ok := reserved[strings.ToLower(code)]
+	return ok
+}
+
+// Generate makes the code of the generator that is not reserved,
+// the reserved one is skipped as the taken code by the next attempt
+func Generate(g CodeGenerator, url string, attempt int) string {
+	for ; ; attempt++ {
+		if code := g.Generate(url, attempt); !Reserved(code) {
+			return code
+		}
+	}
+}
+
+// New makes the generator of the kind, one of constant.ShortGenerator*.
+// The alphabet is the url safe unique chars, the code is of the length
+func New(kind, alphabet string, length int) (CodeGenerator, error) {
+	if len(alphabet) < 2 || !alphabetRe.MatchString(alphabet) {
+		return nil, fmt.Errorf("alphabet %q is not at least 2 of a-z, A-Z, 0-9, _, -", alphabet)
+	}
+	seen := make(map[rune]struct{}, len(alphabet))
+	for _, c := range alphabet {
+		if _, ok := seen[c]; ok {
+			return nil, fmt.Errorf("alphabet %q has %q repeated", alphabet, c)
+		}
+		seen[c] = struct{}{}
+	}
+	if length < constant.ShortMinLen || length > constant.AliasMaxLen {
+		return nil, fmt.Errorf("length %d is not in %d..%d", length, constant.ShortMinLen, constant.AliasMaxLen)
+	}
+	e := encoding{alphabet: alphabet, length: length}
+	switch kind {
+	case constant.ShortGeneratorRandom:
+		return &RandomGenerator{encoding: e}, nil
+	case constant.ShortGeneratorSequence:
+		return NewSequenceGenerator(e, uint64(time.Now().UnixMilli())), nil
+	case constant.ShortGeneratorHash:
+		return &HashGenerator{encoding: e}, nil
+	case constant.ShortGeneratorSortable:
+		return NewSortableGenerator(e)
+	}
+	return nil, fmt.Errorf("generator %q is not one of %s, %s, %s, %s", kind,
+		constant.ShortGeneratorRandom, constant.ShortGeneratorSequence, constant.ShortGeneratorHash, constant.ShortGeneratorSortable)
+}
+
+// Default is the random generator of constant.ShortAlphabet and constant.ShortLen
+func Default() CodeGenerator {
+	return &RandomGenerator{encoding: encoding{alphabet: constant.ShortAlphabet, length: constant.ShortLen}}
+}
+
+type encoding struct {
+	alphabet string
+	length   int
+}
+
+func (e encoding) base() uint64 {
+	return uint64(len(e.alphabet))
+}
+
+func (e encoding) Keyspace() float64 {
+	return math.Pow(float64(len(e.alphabet)), float64(e.length))
+}
+
+func (e encoding) Poolable() bool {
+	return true
+}
+
+// encode writes n as the digits of the alphabet to the code, the most significant first.
+// The digits over the code length are dropped, the missing ones are the first char
+func (e encoding) encode(code []byte, n uint64) {
+	for i := len(code) - 1; i >= 0; i-- {
+		code[i] = e.alphabet[n%e.base()]
+		n /= e.base()
+	}
+}
+
+// random fills the code with the chars of the alphabet chosen uniformly by crypto/rand
+func (e encoding) random(code []byte) {
+	max := big.NewInt(int64(len(e.alphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(fmt.Sprintf("crypto/rand: %v", err))
+		}
+		code[i] = e.alphabet[n.Int64()]
+	}
+}
+
+// RandomGenerator makes the codes of crypto random chars
+type RandomGenerator struct {
+	encoding
+}
+
+func (g *RandomGenerator) Generate(string, int) string {
+	code := make([]byte, g.length)
+	g.random(code)
+	return string(code)
+}
+
+// SequenceGenerator encodes the increasing counter in the base of the alphabet length,
+// base62 with the 62 chars alphabet. The restarted server goes on from the start given,
+// the taken codes are skipped by the attempts
+type SequenceGenerator struct {
+	encoding
+	counter atomic.Uint64
+}
+
+func NewSequenceGenerator(e encoding, start uint64) *SequenceGenerator {
+	g := &SequenceGenerator{encoding: e}
+	g.counter.Store(start)
+	return g
+}
+
+func (g *SequenceGenerator) Generate(string, int) string {
+	code := make([]byte, g.length)
+	g.encode(code, g.counter.Add(1))
+	return string(code)
+}
+
+// HashGenerator makes the stable code of the url: sha256 of the url and the attempt,
+// so the same url gets the same code on any server
+type HashGenerator struct {
+	encoding
+}
+
+func (g *HashGenerator) Generate(url string, attempt int) string {
+	sum := sha256.Sum256([]byte(url + "\x00" + strconv.Itoa(attempt)))
+	// 256 bits are 43 digits of base 62, more than the longest code
+	n, digit, base := new(big.Int).SetBytes(sum[:]), new(big.Int), big.NewInt(int64(len(g.alphabet)))
+	code := make([]byte, g.length)
+	for i := range code {
+		n.DivMod(n, base, digit)
+		code[i] = g.alphabet[digit.Int64()]
+	}
+	return string(code)
+}
+
+func (g *HashGenerator) Poolable() bool {
+	return false
+}
+
+var (
+	// sortableEpoch is the start of the time of the sortable codes
+	sortableEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// sortableYears is the time the sortable codes are ordered
+	sortableYears = 25
+)
+
+// SortableGenerator makes the codes ordered by the creation time: the seconds since
+// sortableEpoch at the width covering sortableYears, then the random chars.
+// The alphabet is sorted, so the codes are ordered as strings
+type SortableGenerator struct {
+	encoding
+	timeLen int
+}
+
+func NewSortableGenerator(e encoding) (*SortableGenerator, error) {
+	chars := []byte(e.alphabet)
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+	e.alphabet = string(chars)
+	g := &SortableGenerator{encoding: e}
+	span := uint64(time.Duration(sortableYears) * 365 * 24 * time.Hour / time.Second)
+	for n := uint64(1); n < span; n *= e.base() {
+		g.timeLen++
+	}
+	if g.timeLen >= e.length {
+		return nil, fmt.Errorf("length %d leaves no random chars after %d time chars", e.length, g.timeLen)
+	}
+	return g, nil
+}
+
+func (g *SortableGenerator) Generate(string, int) string {
+	code := make([]byte, g.length)
+	g.encode(code[:g.timeLen], uint64(time.Since(sortableEpoch)/time.Second))
+	g.random(code[g.timeLen:])
+	return string(code)
+}
+
+// Keyspace is the count of the codes of the one second
+func (g *SortableGenerator) Keyspace() float64 {
+	return math.Pow(float64(len(g.alphabet)), float64(g.length-g.timeLen))
+}
+
+// Poolable is false, the code made ahead would carry the time of the pool refill, not of the creation
+func (g *SortableGenerator) Poolable() bool {
+	return false
+}
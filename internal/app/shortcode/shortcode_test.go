@@ -0,0 +1,106 @@
+package shortcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	for _, kind := range []string{constant.ShortGeneratorRandom, constant.ShortGeneratorSequence, constant.ShortGeneratorHash, constant.ShortGeneratorSortable} {
+		t.Run(kind, func(t *testing.T) {
+			gen, err := New(kind, "0123456789abcdef", 12)
+			require.NoError(t, err)
+			code1, code2 := gen.Generate("https://1.example/", 0), gen.Generate("https://2.example/", 0)
+			assert.Regexp(t, `^[0-9a-f]{12}$`, code1)
+			assert.Regexp(t, `^[0-9a-f]{12}$`, code2)
+			assert.NotEqual(t, code1, code2)
+		})
+	}
+
+	for name, args := range map[string]struct {
+		kind, alphabet string
+		length         int
+	}{
+		"unknown kind":       {"uuid", constant.ShortAlphabet, constant.ShortLen},
+		"repeated char":      {constant.ShortGeneratorRandom, "abca", constant.ShortLen},
+		"not url safe char":  {constant.ShortGeneratorRandom, "ab/c", constant.ShortLen},
+		"one char":           {constant.ShortGeneratorRandom, "a", constant.ShortLen},
+		"too short":          {constant.ShortGeneratorRandom, constant.ShortAlphabet, 2},
+		"too long":           {constant.ShortGeneratorRandom, constant.ShortAlphabet, constant.AliasMaxLen + 1},
+		"no sortable random": {constant.ShortGeneratorSortable, "01", 20},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(args.kind, args.alphabet, args.length)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHashGenerator(t *testing.T) {
+	gen, err := New(constant.ShortGeneratorHash, constant.ShortAlphabet, constant.ShortLen)
+	require.NoError(t, err)
+	url := "https://hash.example/"
+	// the code is stable, the next attempt makes the other one
+	assert.Equal(t, gen.Generate(url, 0), gen.Generate(url, 0))
+	assert.NotEqual(t, gen.Generate(url, 0), gen.Generate(url, 1))
+	assert.Equal(t, gen.Generate(url, 1), gen.Generate(url, 1))
+}
+
+func TestSequenceGenerator(t *testing.T) {
+	gen, err := New(constant.ShortGeneratorSequence, "0123456789", 16)
+	require.NoError(t, err)
+	code1, code2 := gen.Generate("", 0), gen.Generate("", 0)
+	assert.Less(t, code1, code2)
+
+	e := encoding{alphabet: "0123456789", length: 4}
+	assert.Equal(t, "0042", NewSequenceGenerator(e, 41).Generate("", 0))
+}
+
+func TestSortableGenerator(t *testing.T) {
+	gen, err := New(constant.ShortGeneratorSortable, "zyxwvutsrqponmlkjihgfedcba9876543210", 12)
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-z]{12}$`, gen.Generate("", 0))
+
+	// the alphabet is sorted, so the later time is the greater code
+	sortable := gen.(*SortableGenerator)
+	earlier, later := make([]byte, sortable.timeLen), make([]byte, sortable.timeLen)
+	sortable.encode(earlier, 9)
+	sortable.encode(later, 10)
+	assert.Less(t, string(earlier), string(later))
+	assert.Equal(t, math.Pow(36, float64(12-sortable.timeLen)), gen.Keyspace())
+}
+
+func TestCodeGenerator_Poolable(t *testing.T) {
+	for kind, poolable := range map[string]bool{
+		constant.ShortGeneratorRandom:   true,
+		constant.ShortGeneratorSequence: true,
+		constant.ShortGeneratorHash:     false,
+		constant.ShortGeneratorSortable: false,
+	} {
+		gen, err := New(kind, constant.ShortAlphabet, constant.ShortLen)
+		require.NoError(t, err)
+		assert.Equal(t, poolable, gen.Poolable(), kind)
+	}
+}
+
+// codes is the generator of the listed codes, one per attempt
+type codes []string
+
+func (c codes) Generate(_ string, attempt int) string { return c[attempt] }
+func (c codes) Keyspace() float64                     { return float64(len(c)) }
+func (c codes) Poolable() bool                        { return false }
+
+func TestGenerate(t *testing.T) {
+	assert.True(t, Reserved("ping"))
+	assert.True(t, Reserved("API"))
+	assert.False(t, Reserved("pings"))
+
+	// the reserved codes are skipped as taken
+	assert.Equal(t, "abcd", Generate(codes{"ping", "Api", "abcd"}, "", 0))
+	assert.Equal(t, "abcd", Generate(codes{"ping", "abcd"}, "", 1))
+}
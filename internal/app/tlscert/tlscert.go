@@ -0,0 +1,123 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MrSwed/go-musthave-shortener/internal/app/constant"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SelfSigned generates the development certificate for hosts, ip addresses are allowed
+func SelfSigned(hosts ...string) (cert tls.Certificate, err error) {
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	var serial *big.Int
+	if serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Shortener development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(constant.SelfSignedCertTTL * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key); err != nil {
+		return
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+// Reloader serves the certificate from files and reloads it when the files are modified,
+// checking them not often than CertReloadInterval seconds. On a reload error the loaded one is kept
+type Reloader struct {
+	certFile  string
+	keyFile   string
+	log       logrus.FieldLogger
+	m         sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func NewReloader(certFile, keyFile string, log logrus.FieldLogger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, log: log}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files if they were modified since the last load
+func (r *Reloader) Reload() (reloaded bool, err error) {
+	var modTime time.Time
+	if modTime, err = r.filesModTime(); err != nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.checkedAt = time.Now()
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return
+	}
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err != nil {
+		return
+	}
+	r.cert, r.modTime, reloaded = &cert, modTime, true
+	return
+}
+
+func (r *Reloader) filesModTime() (modTime time.Time, err error) {
+	for _, f := range []string{r.certFile, r.keyFile} {
+		var info os.FileInfo
+		if info, err = os.Stat(f); err != nil {
+			return
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return
+}
+
+// GetCertificate is for tls.Config
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.m.RLock()
+	check := time.Since(r.checkedAt) >= constant.CertReloadInterval*time.Second
+	r.m.RUnlock()
+	if check {
+		if reloaded, err := r.Reload(); err != nil {
+			r.log.WithError(err).Error("Certificate reload")
+		} else if reloaded {
+			r.log.WithField("file", r.certFile).Info("Certificate reloaded")
+		}
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,141 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLog() logrus.FieldLogger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+// pemPair returns the pem of the certificate and its key
+func pemPair(t *testing.T, cert tls.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	return
+}
+
+// writeFile writes the file with the modification time of modTime, so the change is seen at once
+func writeFile(t *testing.T, name string, data []byte, modTime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(name, data, 0600))
+	require.NoError(t, os.Chtimes(name, modTime, modTime))
+}
+
+func TestSelfSigned(t *testing.T) {
+	cert, err := SelfSigned("localhost", "127.0.0.1", "")
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"localhost"}, leaf.DNSNames)
+	require.Len(t, leaf.IPAddresses, 1)
+	assert.True(t, leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+	assert.NoError(t, leaf.VerifyHostname("localhost"))
+	assert.NoError(t, leaf.VerifyHostname("127.0.0.1"))
+	assert.Error(t, leaf.VerifyHostname("example.com"))
+	assert.True(t, time.Now().After(leaf.NotBefore) && time.Now().Before(leaf.NotAfter))
+
+	// the key is of the certificate
+	certPEM, keyPEM := pemPair(t, cert)
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	modTime := time.Now().Add(-time.Hour)
+	writePair := func(cert tls.Certificate) {
+		modTime = modTime.Add(time.Second)
+		certPEM, keyPEM := pemPair(t, cert)
+		writeFile(t, certFile, certPEM, modTime)
+		writeFile(t, keyFile, keyPEM, modTime)
+	}
+	served := func(r *Reloader) []byte {
+		cert, err := r.GetCertificate(nil)
+		require.NoError(t, err)
+		return cert.Certificate[0]
+	}
+
+	first, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	writePair(first)
+	r, err := NewReloader(certFile, keyFile, testLog())
+	require.NoError(t, err)
+	assert.Equal(t, first.Certificate[0], served(r))
+
+	t.Run("not modified is not reloaded", func(t *testing.T) {
+		reloaded, err := r.Reload()
+		require.NoError(t, err)
+		assert.False(t, reloaded)
+	})
+
+	second, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	t.Run("reloaded on the modification time change", func(t *testing.T) {
+		writePair(second)
+		reloaded, err := r.Reload()
+		require.NoError(t, err)
+		assert.True(t, reloaded)
+		assert.Equal(t, second.Certificate[0], served(r))
+	})
+
+	t.Run("half written pair is rejected, the loaded one is kept", func(t *testing.T) {
+		third, err := SelfSigned("localhost")
+		require.NoError(t, err)
+		certPEM, keyPEM := pemPair(t, third)
+		modTime = modTime.Add(time.Second)
+		// the new certificate with the old key
+		writeFile(t, certFile, certPEM, modTime)
+		_, err = r.Reload()
+		assert.Error(t, err)
+		assert.Equal(t, second.Certificate[0], served(r))
+
+		// the key cut in the middle of the write
+		writeFile(t, keyFile, keyPEM[:len(keyPEM)/2], modTime)
+		_, err = r.Reload()
+		assert.Error(t, err)
+		assert.Equal(t, second.Certificate[0], served(r))
+
+		writeFile(t, keyFile, keyPEM, modTime)
+		reloaded, err := r.Reload()
+		require.NoError(t, err)
+		assert.True(t, reloaded)
+		assert.Equal(t, third.Certificate[0], served(r))
+	})
+
+	t.Run("served is reloaded after the check interval", func(t *testing.T) {
+		fourth, err := SelfSigned("localhost")
+		require.NoError(t, err)
+		writePair(fourth)
+		before := served(r)
+		r.m.Lock()
+		r.checkedAt = time.Time{}
+		r.m.Unlock()
+		assert.NotEqual(t, fourth.Certificate[0], before, "not checked before the interval")
+		assert.Equal(t, fourth.Certificate[0], served(r))
+	})
+
+	t.Run("no files", func(t *testing.T) {
+		_, err := NewReloader(dir+"/none.pem", keyFile, testLog())
+		assert.Error(t, err)
+	})
+}
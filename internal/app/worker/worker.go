@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Periodic runs the job in background every interval and on Trigger, one run at a time,
+// until it is closed. The job context is cancelled after the timeout, zero timeout is no deadline.
+// Zero interval is no periodic run, the job runs on Trigger only
+type Periodic struct {
+	interval time.Duration
+	timeout  time.Duration
+	job      func(ctx context.Context)
+	trigger  chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewPeriodic(interval, timeout time.Duration, job func(ctx context.Context)) *Periodic {
+	p := &Periodic{
+		interval: interval,
+		timeout:  timeout,
+		job:      job,
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Trigger requests the run at once, the run already requested is not repeated
+func (p *Periodic) Trigger() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Stopped reports the worker is closed
+func (p *Periodic) Stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the worker and waits for the running job
+func (p *Periodic) Close(ctx context.Context) error {
+	p.once.Do(func() { close(p.stop) })
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Periodic) run() {
+	defer close(p.done)
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.trigger:
+		case <-tick:
+		}
+		p.runJob()
+	}
+}
+
+func (p *Periodic) runJob() {
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	p.job(ctx)
+}
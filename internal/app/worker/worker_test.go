@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodic(t *testing.T) {
+	t.Run("runs every interval with the timeout", func(t *testing.T) {
+		var runs atomic.Int32
+		p := NewPeriodic(5*time.Millisecond, time.Minute, func(ctx context.Context) {
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+			runs.Add(1)
+		})
+		assert.Eventually(t, func() bool { return runs.Load() >= 2 }, time.Second, time.Millisecond)
+		assert.False(t, p.Stopped())
+		require.NoError(t, p.Close(context.Background()))
+		assert.True(t, p.Stopped())
+
+		n := runs.Load()
+		p.Trigger()
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, n, runs.Load(), "no run after close")
+	})
+
+	t.Run("zero interval runs on trigger only, zero timeout is no deadline", func(t *testing.T) {
+		runs := make(chan bool, 1)
+		p := NewPeriodic(0, 0, func(ctx context.Context) {
+			_, ok := ctx.Deadline()
+			runs <- ok
+		})
+		defer func() { require.NoError(t, p.Close(context.Background())) }()
+		select {
+		case <-runs:
+			t.Fatal("run with no trigger")
+		case <-time.After(10 * time.Millisecond):
+		}
+		p.Trigger()
+		assert.False(t, <-runs)
+	})
+
+	t.Run("close waits for the running job", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		p := NewPeriodic(0, 0, func(context.Context) {
+			close(started)
+			<-release
+		})
+		p.Trigger()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, p.Close(ctx), context.DeadlineExceeded)
+		close(release)
+		assert.NoError(t, p.Close(context.Background()))
+	})
+}